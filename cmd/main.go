@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"k8s.io/client-go/kubernetes"
@@ -10,15 +15,26 @@ import (
 
 	"github.com/brwallis/srlinux-kbutler/internal/agent"
 	"github.com/brwallis/srlinux-kbutler/internal/endpointmgr"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/fleetmgr"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/introspect"
 	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+	"github.com/brwallis/srlinux-kbutler/internal/nodemgr"
+	"github.com/brwallis/srlinux-kbutler/internal/options"
+	"github.com/brwallis/srlinux-kbutler/internal/policymgr"
+	"github.com/brwallis/srlinux-kbutler/internal/routemgr"
 	"github.com/brwallis/srlinux-kbutler/internal/servicemgr"
 )
 
 const (
-	// ndkAddress = "localhost:50053"
-	ndkAddress = "unix:///opt/srlinux/var/run/sr_sdk_service_manager:50053"
-	agentName  = "kbutler"
-	yangRoot   = ".kbutler"
+	// startupRetryInterval is how long to wait before retrying a failed startup phase
+	startupRetryInterval = 5 * time.Second
+	// configTimeout is how long to wait for the initial configuration before starting with the defaults
+	configTimeout = 30 * time.Second
+	// shutdownTimeout bounds how long kbutler takes to shut down once signalled
+	shutdownTimeout = 10 * time.Second
 )
 
 // Global vars
@@ -26,6 +42,12 @@ var (
 	KButler agent.Agent
 )
 
+// manager is started once Kubernetes is reachable, running until the root context is cancelled
+type manager struct {
+	name  string
+	start func(context.Context, *kubernetes.Clientset, *agent.Agent)
+}
+
 // SetName publishes the baremetal's hostname into the container
 func SetName(nodeName string) {
 	log.Infof("Setting node name...")
@@ -55,6 +77,8 @@ func PodCounterMgr(clientSet *kubernetes.Clientset, nodeName string) {
 
 // SetController updates the NDK with a Kubernetes controller IP address
 func SetController(kubeConfig *rest.Config) {
+	KButler.Lock()
+	defer KButler.Unlock()
 	if kubeConfig.Host != "" {
 		KButler.Yang.Controller.Value = kubeConfig.Host
 	} else {
@@ -64,44 +88,250 @@ func SetController(kubeConfig *rest.Config) {
 	KButler.UpdateBaseTelemetry()
 }
 
+// kubernetesClient connects to the Kubernetes API server, then switches to the gNMI credentials held by a Secret if configured.
+// It returns false if the context is cancelled first
+func kubernetesClient(ctx context.Context, opts options.Options) (*kubernetes.Clientset, *rest.Config, bool) {
+	var clientSet *kubernetes.Clientset
+	var kubeConfig *rest.Config
+	log.Infof("Initializing K8 client...")
+	if !retry(ctx, agent.PhaseKubernetesReady, func() error {
+		var err error
+		clientSet, kubeConfig, err = k8s.Client(opts.KubeConfig)
+		if err != nil || opts.GNMICredentialsSecret == "" {
+			return err
+		}
+		err = useGNMISecret(ctx, opts, clientSet)
+		if err == nil {
+			return nil
+		}
+		// Without other credentials configured, there are none to fall back to
+		if opts.GNMIUsername == "" && opts.GNMICredentialsFile == "" {
+			return err
+		}
+		log.Errorf("Keeping the configured gNMI credentials: %v", err)
+		return nil
+	}) {
+		return nil, nil, false
+	}
+	return clientSet, kubeConfig, true
+}
+
+// gnmiConfig returns how to reach the gNMI server, with the credentials held by the gNMI credentials Secret if configured
+func gnmiConfig(ctx context.Context, opts options.Options, clientSet *kubernetes.Clientset) (fabric.GNMIConfig, error) {
+	cfg, err := opts.GNMIConfig()
+	if err != nil || opts.GNMICredentialsSecret == "" {
+		return cfg, err
+	}
+	username, password, err := k8s.BasicAuthSecret(ctx, clientSet, opts.GNMICredentialsSecret)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to use gNMI credentials from secret %s: %v", opts.GNMICredentialsSecret, err)
+	}
+	cfg.Username, cfg.Password = username, password
+	return cfg, nil
+}
+
+// useGNMISecret reconnects to the gNMI server with the credentials held by the gNMI credentials Secret
+func useGNMISecret(ctx context.Context, opts options.Options, clientSet *kubernetes.Clientset) error {
+	cfg, err := gnmiConfig(ctx, opts, clientSet)
+	if err != nil {
+		return err
+	}
+	client, err := fabric.NewGNMIClient(cfg)
+	if err != nil {
+		return err
+	}
+	fabric.SetGNMIClient(client)
+	return nil
+}
+
+// fleetSwitches connects to each switch of the fleet, with the same gNMI TLS options and credentials as the gNMI server
+func fleetSwitches(ctx context.Context, opts options.Options, clientSet *kubernetes.Clientset) ([]*fabric.Switch, error) {
+	// As for the gNMI server, the configured credentials are used if the Secret can't be read
+	cfg, err := gnmiConfig(ctx, opts, clientSet)
+	if err != nil {
+		log.Errorf("Using the configured gNMI credentials for the fleet: %v", err)
+	}
+	var switches []*fabric.Switch
+	for _, s := range opts.Fleet {
+		cfg.Target = s.Target
+		client, err := fabric.NewGNMIClient(cfg)
+		if err != nil {
+			for _, connected := range switches {
+				connected.Close()
+			}
+			return nil, fmt.Errorf("fleet switch %s: %v", s.Name, err)
+		}
+		switches = append(switches, fabric.NewSwitch(s.Name, s.Role, client))
+	}
+	return switches, nil
+}
+
+// retry runs a startup phase until it succeeds, recording each failure against the phase.
+// It returns false if the context is cancelled first
+func retry(ctx context.Context, phase string, fn func() error) bool {
+	KButler.SetPhase(phase, agent.PhasePending, "")
+	for {
+		err := fn()
+		if err == nil {
+			KButler.SetPhase(phase, agent.PhaseComplete, "")
+			return true
+		}
+		KButler.SetPhase(phase, agent.PhaseFailed, err.Error())
+		select {
+		case <-time.After(startupRetryInterval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
 func main() {
 	var KubeClientSet *kubernetes.Clientset
 	var KubeConfig *rest.Config
 	// nodeName := os.Getenv("KUBERNETES_NODE_NAME")
 	// nodeIP := os.Getenv("KUBERNETES_NODE_IP")
 
-	log.Infof("Initializing NDK...")
-	KButler = agent.Agent{}
-	KButler.Init(agentName, ndkAddress, yangRoot)
+	opts, err := options.Load(os.Args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Exitf("Invalid options: %v", err)
+	}
+	if err := opts.Apply(); err != nil {
+		log.Exitf("Invalid options: %v", err)
+	}
+	defaultConfig, err := opts.AgentConfig()
+	if err != nil {
+		log.Exitf("Invalid options: %v", err)
+	}
+	log.Infof("Options: %+v", opts)
 
-	log.Infof("Starting to receive notifications from NDK...")
-	KButler.Wg.Add(1)
-	go KButler.ReceiveNotifications()
+	// The root context is cancelled on SIGTERM or SIGINT, stopping everything started from it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
-	time.Sleep(2 * time.Second)
-	log.Infof("Initializing K8 client...")
-	// KubeClientSet := k8s.K8Init()
-	if os.Getenv("KUBERNETES_CONFIG") != "" {
-		KubeClientSet, KubeConfig = k8s.Client(os.Getenv("KUBERNETES_CONFIG"))
+	KButler = agent.Agent{}
+	KButler.DefaultConfig = defaultConfig
+	KButler.ResyncPeriod = time.Duration(opts.ResyncPeriod)
+	// The API is served once configured, so must be registered before configuration is received
+	introspect.API(&KButler)
+
+	if opts.Standalone {
+		// The gNMI credentials may be held by a Secret, so Kubernetes is reached first
+		var ok bool
+		if KubeClientSet, KubeConfig, ok = kubernetesClient(ctx, opts); !ok {
+			return
+		}
+		log.Infof("Connecting to %s...", opts.GNMITarget)
+		var hostname string
+		if !retry(ctx, agent.PhaseGNMIConnected, func() error {
+			var err error
+			hostname, err = fabric.Hostname()
+			return err
+		}) {
+			return
+		}
+		KButler.InitStandalone(opts.AgentName, hostname, opts.YangRoot, agent.APISink{})
 	} else {
-		log.Errorf("Unable to initialize K8 client set, env var KUBERNETES_CONFIG not set")
+		log.Infof("Initializing NDK...")
+		if !retry(ctx, agent.PhaseNDKRegistered, func() error {
+			return KButler.Init(ctx, opts.AgentName, opts.NDKAddress, opts.YangRoot)
+		}) {
+			return
+		}
+	}
+
+	health.Register("gnmi", fabric.Reachable)
+	go health.Run(ctx)
+
+	// There is no configuration from NDK in standalone mode, the defaults are applied as the configuration
+	if !opts.Standalone {
+		log.Infof("Starting to receive notifications from NDK...")
+		KButler.Wg.Add(1)
+		go KButler.ReceiveNotifications(ctx)
+
+		// Configuration arriving later is still applied, kbutler just starts with the defaults
+		log.Infof("Waiting for configuration...")
+		KButler.SetPhase(agent.PhaseConfigReceived, agent.PhasePending, "")
+		select {
+		case <-KButler.ConfigReceived():
+		case <-time.After(configTimeout):
+			KButler.SetPhase(agent.PhaseConfigReceived, agent.PhaseFailed, fmt.Sprintf("no configuration received within %s, starting with defaults", configTimeout))
+		case <-ctx.Done():
+			shutdown()
+			return
+		}
+
+		var ok bool
+		if KubeClientSet, KubeConfig, ok = kubernetesClient(ctx, opts); !ok {
+			shutdown()
+			return
+		}
 	}
 	log.Infof("KubeConfig: %#v", KubeConfig)
 	SetController(KubeConfig)
 
+	// Events are sourced from the switch kbutler is running on, or monitoring when standalone
+	KButler.Recorder = k8s.NewEventRecorder(KubeClientSet, KButler.Hostname)
+
 	// log.Infof("Starting PodCounterMgr...")
 	// KButler.Wg.Add(1)
 	// go PodCounterMgr(KubeClientSet, nodeName)
 
-	log.Infof("Starting ServiceMgr...")
-	KButler.Wg.Add(1)
-	go servicemgr.ServiceMgr(KubeClientSet, &KButler)
+	KButler.SetPhase(agent.PhaseCachesSynced, agent.PhasePending, "")
+	managers := []manager{
+		{"ServiceMgr", servicemgr.ServiceMgr},
+		{"EndpointMgr", endpointmgr.EndpointMgr},
+		{"NodeMgr", nodemgr.NodeMgr},
+		{"RouteMgr", routemgr.RouteMgr},
+	}
+	// Network policy ACLs are written to the configuration of the switch, which is only monitored in standalone mode
+	if !opts.Standalone {
+		managers = append(managers, manager{"PolicyMgr", policymgr.PolicyMgr})
+	}
+	if len(opts.Fleet) > 0 {
+		switches, err := fleetSwitches(ctx, opts, KubeClientSet)
+		if err != nil {
+			log.Exitf("Unable to connect to the fleet: %v", err)
+		}
+		if err := fleetmgr.Init(KubeConfig, switches, time.Duration(opts.FleetInterval)); err != nil {
+			log.Exitf("Unable to initialize FleetMgr: %v", err)
+		}
+		managers = append(managers, manager{"FleetMgr", fleetmgr.FleetMgr})
+	}
+	for _, m := range managers {
+		log.Infof("Starting %s...", m.name)
+		KButler.Wg.Add(1)
+		KButler.CacheSync.Add(1)
+		go m.start(ctx, KubeClientSet, &KButler)
+	}
+	go func() {
+		KButler.CacheSync.Wait()
+		KButler.SetPhase(agent.PhaseCachesSynced, agent.PhaseComplete, "")
+	}()
+
+	<-ctx.Done()
+	// A second signal kills kbutler without waiting for shutdown
+	stop()
+	shutdown()
+}
 
-	log.Infof("Starting EndpointMgr...")
-	KButler.Wg.Add(1)
-	go endpointmgr.EndpointMgr(KubeClientSet, &KButler)
+// shutdown waits for the managers and notification stream to stop, then unregisters from NDK unless standalone, exiting if this takes longer than shutdownTimeout
+func shutdown() {
+	log.Infof("Shutting down...")
+	timer := time.AfterFunc(shutdownTimeout, func() {
+		log.Exitf("Shutdown did not complete within %s, exiting!", shutdownTimeout)
+	})
+	defer timer.Stop()
 
 	KButler.Wg.Wait()
+	metrics.Listen("")
+	health.Listen("")
+	introspect.Listen("")
 
-	KButler.GrpcConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	KButler.Shutdown(ctx)
+	log.Infof("Shutdown complete")
 }
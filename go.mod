@@ -4,11 +4,15 @@ go 1.16
 
 require (
 	github.com/brwallis/srlinux-go v0.0.0-20210511011823-da7e6698cf53
+	github.com/google/gnxi v0.0.0-20210301094713-a533bddd461b
+	github.com/openconfig/gnmi v0.0.0-20210226144353-8eae1937bf84
 	github.com/openconfig/goyang v0.2.4
 	github.com/openconfig/ygot v0.10.8
+	github.com/prometheus/client_golang v1.10.0
 	google.golang.org/grpc v1.37.0
 	k8s.io/api v0.21.0
 	k8s.io/apimachinery v0.21.0
 	k8s.io/client-go v0.21.0
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -67,15 +67,16 @@ done
 mkdir -p ${SRL_ETC_DIR}/kbutler/bin
 mkdir -p ${SRL_ETC_DIR}/kbutler/yang
 mkdir -p ${SRL_ETC_DIR}/appmgr
-# Add in the K8 service host/port, these are lost when app_mgr launches an application
+# Pass the K8 service host/port in the options file, the environment is lost when app_mgr launches an application
 # These env vars always exist when running inside K8
 echo "Kubernetes service host is: $KUBERNETES_SERVICE_HOST"
 echo "Kubernetes service port is: $KUBERNETES_SERVICE_PORT"
-echo "Updating $KBUTLER_CONFIG..."
-sed -i 's/$KUBERNETES_SERVICE_HOST/'"$KUBERNETES_SERVICE_HOST"'/' "$KBUTLER_CONFIG"
-sed -i 's/$KUBERNETES_SERVICE_PORT/'"$KUBERNETES_SERVICE_PORT"'/' "$KBUTLER_CONFIG"
-sed -i 's/$KUBERNETES_NODE_NAME/'"$KUBERNETES_NODE_NAME"'/' "$KBUTLER_CONFIG"
-sed -i 's/$KUBERNETES_NODE_IP/'"$KUBERNETES_NODE_IP"'/' "$KBUTLER_CONFIG"
+echo "Writing $SRL_ETC_DIR/kbutler/kbutler.yml..."
+cat > "$SRL_ETC_DIR/kbutler/kbutler.yml" <<EOF
+kubernetes-service-host: "$KUBERNETES_SERVICE_HOST"
+kubernetes-service-port: "$KUBERNETES_SERVICE_PORT"
+gnmi-credentials-secret: "$KBUTLER_GNMI_CREDENTIALS_SECRET"
+EOF
 # Copy files into proper places
 cp -f "$KBUTLER_BIN_FILE" "$SRL_ETC_DIR/kbutler/bin/"
 cp -f "$KBUTLER_YANG" "$SRL_ETC_DIR/kbutler/yang/"
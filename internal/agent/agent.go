@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"sync"
 	"time"
 
+	"k8s.io/client-go/tools/record"
 	log "k8s.io/klog"
 
 	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
 	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
@@ -36,25 +40,85 @@ type EndpointKey struct {
 
 // Agent represents an instance of an NDK agent
 type Agent struct {
-	m *sync.RWMutex
+	// m guards YangService, YangEndpoint, YangACL, YangRoute and ServiceMap, which are updated by the managers and read by the API
+	m sync.RWMutex
 
 	Name     string
+	Hostname string
 	OwnAppID uint32
 	StreamID uint64
 	Client   protos.SdkMgrServiceClient
 	GrpcConn *grpc.ClientConn
-	Wg       sync.WaitGroup
+	// Sink is where the state of the agent is published, NDK telemetry unless running standalone
+	Sink TelemetrySink
+	// Standalone is set when running without NDK, monitoring a switch over gNMI only
+	Standalone bool
+	Wg         sync.WaitGroup
+	// CacheSync is done once each manager has synced its informer caches
+	CacheSync sync.WaitGroup
+	// ResyncPeriod is the resync period of the informers of each manager
+	ResyncPeriod time.Duration
+	Recorder     record.EventRecorder
 
 	CfgTranxMap map[string][]CfgTranxEntry
 
-	Yang         config.AgentYang
-	YangService  map[ServiceKey]*config.Service
-	YangEndpoint map[EndpointKey]*config.Endpoint
-	YangRoot     string
+	// cfgMu guards cfg, which is replaced by configuration events and read by the managers through Config
+	cfgMu sync.RWMutex
+	cfg   config.AgentConfig
+	// DefaultConfig is the configuration used until the agent is configured
+	DefaultConfig config.AgentConfig
+	Yang          config.AgentYang
+	YangService   map[ServiceKey]*config.Service
+	YangEndpoint  map[EndpointKey]*config.Endpoint
+	YangNode      map[string]*config.Node
+	YangACL       map[ServiceKey][]config.ACLEntry
+	YangRoute     map[ServiceKey][]config.OwnedRoute
+	YangRoot      string
 
 	ServiceMap map[ServiceKey][]EndpointKey
 }
 
+// Lock locks the published state for writing
+func (a *Agent) Lock() {
+	a.m.Lock()
+}
+
+// Unlock unlocks the published state for writing
+func (a *Agent) Unlock() {
+	a.m.Unlock()
+}
+
+// RLock locks the published state for reading
+func (a *Agent) RLock() {
+	a.m.RLock()
+}
+
+// RUnlock unlocks the published state for reading
+func (a *Agent) RUnlock() {
+	a.m.RUnlock()
+}
+
+// Config returns a copy of the current configuration of the agent
+func (a *Agent) Config() config.AgentConfig {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	return copyConfig(a.cfg)
+}
+
+// setConfig replaces the configuration of the agent
+func (a *Agent) setConfig(cfg config.AgentConfig) {
+	a.cfgMu.Lock()
+	defer a.cfgMu.Unlock()
+	a.cfg = copyConfig(cfg)
+}
+
+// copyConfig returns a copy of a configuration, leaf-lists are copied so the copy shares no backing array with cfg
+func copyConfig(cfg config.AgentConfig) config.AgentConfig {
+	cfg.ACLSubinterfaces = append([]config.Name(nil), cfg.ACLSubinterfaces...)
+	cfg.PublishedMetadata = append([]config.Name(nil), cfg.PublishedMetadata...)
+	return cfg
+}
+
 func (a *Agent) GetName() string {
 	return a.Name
 }
@@ -71,139 +135,353 @@ func (a *Agent) SetStreamID(streamID uint64) {
 	a.StreamID = streamID
 }
 
-func (a *Agent) UpdateTelemetry(jsPath *string, jsData *string) *protos.TelemetryUpdateResponse {
-	ctx := context.Background()
+// servicePath returns the telemetry path for a service
+func (a *Agent) servicePath(serviceKey ServiceKey) string {
+	return fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}", a.YangRoot, serviceKey.Name, serviceKey.Namespace)
+}
 
-	// Set up agent name
-	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.Name)
-	telClient := protos.NewSdkMgrTelemetryServiceClient(a.GrpcConn)
+// endpointPath returns the telemetry path for an external address of a service
+func (a *Agent) endpointPath(serviceKey ServiceKey, endpointKey EndpointKey) string {
+	return fmt.Sprintf("%s.external_address{.address==\"%s\"&&.hostname==\"%s\"}", a.servicePath(serviceKey), endpointKey.ExternalAddress, endpointKey.Hostname)
+}
 
-	key := &protos.TelemetryKey{JsPath: *jsPath}
-	data := &protos.TelemetryData{JsonContent: *jsData}
-	entry := &protos.TelemetryInfo{Key: key, Data: data}
-	telReq := &protos.TelemetryUpdateRequest{}
-	telReq.State = make([]*protos.TelemetryInfo, 0)
-	telReq.State = append(telReq.State, entry)
+func (a *Agent) UpdateEndpointTelemetry(serviceKey ServiceKey, endpointKey EndpointKey) {
+	a.updateTelemetryData(a.endpointPath(serviceKey, endpointKey), a.YangEndpoint[endpointKey])
+}
 
-	result, err := telClient.TelemetryAddOrUpdate(ctx, telReq)
-	if err != nil {
-		log.Fatalf("Could not update telemetry for key : %s", jsPath)
+func (a *Agent) UpdateServiceTelemetry(serviceKey ServiceKey) {
+	a.updateTelemetryData(a.servicePath(serviceKey), a.YangService[serviceKey])
+}
+
+// UpdateServiceSpecTelemetry publishes the ports, ingress addresses, labels and annotations of a service,
+// deleting any entries present in the previously published service that no longer exist
+func (a *Agent) UpdateServiceSpecTelemetry(serviceKey ServiceKey, old *config.Service) {
+	service := a.YangService[serviceKey]
+	servicePath := a.servicePath(serviceKey)
+
+	portPath := func(port config.ServicePort) string {
+		return fmt.Sprintf("%s.port{.port==%d&&.protocol==\"%s\"}", servicePath, port.Port, port.Protocol)
+	}
+	ingressPath := func(address string) string {
+		return fmt.Sprintf("%s.ingress{.address==\"%s\"}", servicePath, address)
+	}
+	labelPath := func(name string) string {
+		return fmt.Sprintf("%s.label{.name==\"%s\"}", servicePath, name)
+	}
+	annotationPath := func(name string) string {
+		return fmt.Sprintf("%s.annotation{.name==\"%s\"}", servicePath, name)
+	}
+
+	for _, port := range service.Port {
+		a.updateTelemetryData(portPath(port), port)
+	}
+	for _, address := range service.Ingress {
+		a.updateTelemetryData(ingressPath(address), struct{}{})
+	}
+	for name, value := range service.Label {
+		a.updateTelemetryData(labelPath(name), config.Metadata{Value: config.Name{Value: value}})
+	}
+	for name, value := range service.Annotation {
+		a.updateTelemetryData(annotationPath(name), config.Metadata{Value: config.Name{Value: value}})
+	}
+
+	if old == nil {
+		return
+	}
+	for _, oldPort := range old.Port {
+		portMatched := false
+		for _, port := range service.Port {
+			if port.Port == oldPort.Port && port.Protocol == oldPort.Protocol {
+				portMatched = true
+			}
+		}
+		if !portMatched {
+			jsPath := portPath(oldPort)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
+	for _, oldAddress := range old.Ingress {
+		addressMatched := false
+		for _, address := range service.Ingress {
+			if address == oldAddress {
+				addressMatched = true
+			}
+		}
+		if !addressMatched {
+			jsPath := ingressPath(oldAddress)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
+	for name := range old.Label {
+		if _, ok := service.Label[name]; !ok {
+			jsPath := labelPath(name)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
+	for name := range old.Annotation {
+		if _, ok := service.Annotation[name]; !ok {
+			jsPath := annotationPath(name)
+			a.DeleteTelemetry(&jsPath)
+		}
 	}
-	log.Infof("Telemetry add/update status: %s error_string: %s", result.GetStatus(), result.GetErrorStr())
-	return result
 }
 
-func (a *Agent) UpdateEndpointTelemetry(serviceKey ServiceKey, endpointKey EndpointKey) {
-	jsPath := fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}.external_address{.address==\"%s\"&&.hostname==\"%s\"}", a.YangRoot, serviceKey.Name, serviceKey.Namespace, endpointKey.ExternalAddress, endpointKey.Hostname)
-	jsData, err := json.Marshal(a.YangEndpoint[endpointKey])
-	if err != nil {
-		log.Fatalf("Can not marshal config data: error %s", err)
+// UpdateEndpointPodTelemetry publishes the backend pods of an external address,
+// deleting any pods present in the previously published external address that no longer exist
+func (a *Agent) UpdateEndpointPodTelemetry(serviceKey ServiceKey, endpointKey EndpointKey, old *config.Endpoint) {
+	endpoint := a.YangEndpoint[endpointKey]
+	endpointPath := a.endpointPath(serviceKey, endpointKey)
+
+	podPath := func(pod config.BackendPod) string {
+		return fmt.Sprintf("%s.backend_pod{.namespace==\"%s\"&&.name==\"%s\"}", endpointPath, pod.Namespace, pod.Name)
 	}
-	jsString := string(jsData)
-	result := a.UpdateTelemetry(&jsPath, &jsString)
 
-	log.Infof("Telemetry add/update status: %s error_string: %s", result.GetStatus(), result.GetErrorStr())
+	for _, pod := range endpoint.Pod {
+		a.updateTelemetryData(podPath(pod), pod)
+	}
+
+	if old == nil {
+		return
+	}
+	for _, oldPod := range old.Pod {
+		podMatched := false
+		for _, pod := range endpoint.Pod {
+			if pod.Namespace == oldPod.Namespace && pod.Name == oldPod.Name {
+				podMatched = true
+			}
+		}
+		if !podMatched {
+			jsPath := podPath(oldPod)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
 }
 
-func (a *Agent) UpdateServiceTelemetry(serviceKey ServiceKey) {
-	jsPath := fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}", a.YangRoot, serviceKey.Name, serviceKey.Namespace)
-	jsData, err := json.Marshal(a.YangService[serviceKey])
-	if err != nil {
-		log.Fatalf("Can not marshal config data: error %s", err)
+// UpdateServiceACLTelemetry publishes the ACL entries rendered for a service,
+// deleting any entries previously published for the service that no longer exist
+func (a *Agent) UpdateServiceACLTelemetry(serviceKey ServiceKey, old []config.ACLEntry) {
+	servicePath := a.servicePath(serviceKey)
+
+	aclEntryPath := func(entry config.ACLEntry) string {
+		return fmt.Sprintf("%s.acl_entry{.sequence_id==%d}", servicePath, entry.SequenceID)
 	}
-	jsString := string(jsData)
-	result := a.UpdateTelemetry(&jsPath, &jsString)
 
-	log.Infof("Telemetry add/update status: %s error_string: %s", result.GetStatus(), result.GetErrorStr())
+	for _, entry := range a.YangACL[serviceKey] {
+		a.updateTelemetryData(aclEntryPath(entry), entry)
+	}
+	for _, oldEntry := range old {
+		entryMatched := false
+		for _, entry := range a.YangACL[serviceKey] {
+			if entry.SequenceID == oldEntry.SequenceID {
+				entryMatched = true
+			}
+		}
+		if !entryMatched {
+			jsPath := aclEntryPath(oldEntry)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
 }
 
-func (a *Agent) UpdateBaseTelemetry() {
-	jsData, err := json.Marshal(a.Yang)
-	if err != nil {
-		log.Fatalf("Can not marshal config data: error %s", err)
+// UpdateServiceRouteTelemetry publishes the routes kbutler programs for a service,
+// deleting any routes present in the previously published list that no longer exist
+func (a *Agent) UpdateServiceRouteTelemetry(serviceKey ServiceKey, old []config.OwnedRoute) {
+	servicePath := a.servicePath(serviceKey)
+
+	routePath := func(route config.OwnedRoute) string {
+		return fmt.Sprintf("%s.route{.prefix==\"%s\"}", servicePath, route.Prefix)
 	}
-	jsString := string(jsData)
-	result := a.UpdateTelemetry(&a.YangRoot, &jsString)
 
-	log.Infof("Telemetry add/update status: %s error_string: %s", result.GetStatus(), result.GetErrorStr())
+	for _, route := range a.YangRoute[serviceKey] {
+		a.updateTelemetryData(routePath(route), route)
+	}
+	for _, oldRoute := range old {
+		routeMatched := false
+		for _, route := range a.YangRoute[serviceKey] {
+			if route.Prefix == oldRoute.Prefix {
+				routeMatched = true
+			}
+		}
+		if !routeMatched {
+			jsPath := routePath(oldRoute)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
 }
 
-// DeleteEndpoint sends a delete to NDK for the specified service + endpoint
-func (a *Agent) DeleteEndpoint(serviceKey ServiceKey, endpointKey EndpointKey) {
-	jsPath := fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}.external_address{.address==\"%s\"&&.hostname==\"%s\"}", a.YangRoot, serviceKey.Name, serviceKey.Namespace, endpointKey.ExternalAddress, endpointKey.Hostname)
-	a.DeleteTelemetry(&jsPath)
+// nodePath returns the telemetry path for a node
+func (a *Agent) nodePath(name string) string {
+	return fmt.Sprintf("%s.node{.name==\"%s\"}", a.YangRoot, name)
 }
 
-// DeleteTelemetry sends a delete to NDK for the specified path
-func (a *Agent) DeleteTelemetry(JsPath *string) {
-	ctx := context.Background()
+// UpdateNodeTelemetry publishes a node along with its pod CIDRs and interfaces,
+// deleting any pod CIDRs or interfaces present in the previously published node that no longer exist
+func (a *Agent) UpdateNodeTelemetry(name string, old *config.Node) {
+	node := a.YangNode[name]
+	nodePath := a.nodePath(name)
 
-	// Set up agent name
-	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.Name)
-	telClient := protos.NewSdkMgrTelemetryServiceClient(a.GrpcConn)
+	podCIDRPath := func(podCIDR config.PodCIDR) string {
+		return fmt.Sprintf("%s.pod_cidr{.prefix==\"%s\"}", nodePath, podCIDR.Prefix)
+	}
+	interfacePath := func(nodeInterface config.NodeInterface) string {
+		return fmt.Sprintf("%s.interface{.name==\"%s\"}", nodePath, nodeInterface.Name)
+	}
 
-	key := &protos.TelemetryKey{JsPath: *JsPath}
-	telReq := &protos.TelemetryDeleteRequest{}
-	telReq.Key = make([]*protos.TelemetryKey, 0)
-	telReq.Key = append(telReq.Key, key)
+	a.updateTelemetryData(nodePath, node)
+	for _, podCIDR := range node.PodCIDR {
+		a.updateTelemetryData(podCIDRPath(podCIDR), podCIDR)
+	}
+	for _, nodeInterface := range node.Interface {
+		a.updateTelemetryData(interfacePath(nodeInterface), nodeInterface)
+	}
 
-	r1, err := telClient.TelemetryDelete(ctx, telReq)
-	if err != nil {
-		log.Fatalf("Could not delete telemetry for key : %s", *JsPath)
+	if old == nil {
+		return
+	}
+	for _, oldPodCIDR := range old.PodCIDR {
+		podCIDRMatched := false
+		for _, podCIDR := range node.PodCIDR {
+			if podCIDR.Prefix == oldPodCIDR.Prefix {
+				podCIDRMatched = true
+			}
+		}
+		if !podCIDRMatched {
+			jsPath := podCIDRPath(oldPodCIDR)
+			a.DeleteTelemetry(&jsPath)
+		}
+	}
+	for _, oldInterface := range old.Interface {
+		interfaceMatched := false
+		for _, nodeInterface := range node.Interface {
+			if nodeInterface.Name == oldInterface.Name {
+				interfaceMatched = true
+			}
+		}
+		if !interfaceMatched {
+			jsPath := interfacePath(oldInterface)
+			a.DeleteTelemetry(&jsPath)
+		}
 	}
-	log.Infof("Telemetry delete status: %s error_string: %s", r1.GetStatus(), r1.GetErrorStr())
 }
 
-// AgentInit initializes an agent
-func (a *Agent) Init(name string, ndkAddress string, yangRoot string) {
-	var err error
+// DeleteNode sends a delete to NDK for the specified node
+func (a *Agent) DeleteNode(name string) {
+	jsPath := a.nodePath(name)
+	a.DeleteTelemetry(&jsPath)
+	delete(a.YangNode, name)
+}
+
+// UpdateBaseTelemetry publishes the state of the agent itself, the agent lock must be held
+func (a *Agent) UpdateBaseTelemetry() {
+	a.updateTelemetryData(a.YangRoot, a.Yang)
+}
+
+// DeleteEndpoint sends a delete to NDK for the specified service + endpoint
+func (a *Agent) DeleteEndpoint(serviceKey ServiceKey, endpointKey EndpointKey) {
+	jsPath := a.endpointPath(serviceKey, endpointKey)
+	a.DeleteTelemetry(&jsPath)
+	delete(a.YangEndpoint, endpointKey)
+}
+
+// DeleteService sends a delete to NDK for the specified service, which removes its external addresses along with it,
+// and forgets the service and its external addresses. Services that were never published are ignored
+func (a *Agent) DeleteService(serviceKey ServiceKey) {
+	endpointKeys, mapped := a.ServiceMap[serviceKey]
+	_, published := a.YangService[serviceKey]
+	if !mapped && !published {
+		return
+	}
+	jsPath := a.servicePath(serviceKey)
+	a.DeleteTelemetry(&jsPath)
+	for _, endpointKey := range endpointKeys {
+		delete(a.YangEndpoint, endpointKey)
+	}
+	delete(a.ServiceMap, serviceKey)
+	delete(a.YangService, serviceKey)
+}
+
+// Init registers the agent with NDK and subscribes to notifications, returning an error if any step fails so that it can be retried
+func (a *Agent) Init(ctx context.Context, name string, ndkAddress string, yangRoot string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
 	// Set up a connection to the server.
-	conn, err := grpc.Dial(ndkAddress, grpc.WithInsecure(), grpc.WithBlock())
+	conn, err := grpc.DialContext(ctx, ndkAddress, grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		return fmt.Errorf("did not connect: %v", err)
 	}
 
 	// Set up base service client
 	client := protos.NewSdkMgrServiceClient(conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// Set up agent name
-	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", name)
-
 	// Register agent with NDK manager
-	r, err := client.AgentRegister(ctx, &protos.AgentRegistrationRequest{})
+	r, err := client.AgentRegister(metadata.AppendToOutgoingContext(ctx, "agent_name", name), &protos.AgentRegistrationRequest{})
 	if err != nil {
-		log.Fatalf("Could not register: %v", err)
+		conn.Close()
+		return fmt.Errorf("could not register: %v", err)
 	}
 	log.Infof("Agent registration status: %s AppId: %d\n", r.Status, r.GetAppId())
 
 	a.Name = name
+	a.Hostname, err = os.Hostname()
+	if err != nil {
+		log.Errorf("Unable to determine hostname: %v", err)
+	}
 	a.GrpcConn = conn
-	a.Client = client
 	a.OwnAppID = r.GetAppId()
 	a.YangRoot = yangRoot
 
+	if err := subscribeStreams(ctx, a, client); err != nil {
+		conn.Close()
+		return err
+	}
+	a.Client = client
+	a.initState()
+	a.Sink = ndkSink{a: a}
+
+	a.registerHealth()
+	a.registerGNMIStatus()
+	a.publishPhases()
+	return nil
+}
+
+// InitStandalone initializes the agent without NDK, publishing its state to sink. hostname is the name of the switch
+// monitored over gNMI. The default configuration is applied as there is no configuration from NDK
+func (a *Agent) InitStandalone(name string, hostname string, yangRoot string, sink TelemetrySink) {
+	a.Name = name
+	a.Hostname = hostname
+	a.YangRoot = yangRoot
+	a.Standalone = true
+	a.initState()
+	a.Sink = sink
+
+	a.registerHealth()
+	a.registerGNMIStatus()
+	a.publishPhases()
+	a.configChanged()
+}
+
+// initState resets the configuration and published state of the agent
+func (a *Agent) initState() {
 	a.CfgTranxMap = make(map[string][]CfgTranxEntry)
+	a.setConfig(a.DefaultConfig)
 	a.YangService = make(map[ServiceKey]*config.Service)
 	a.YangEndpoint = make(map[EndpointKey]*config.Endpoint)
+	a.YangNode = make(map[string]*config.Node)
+	a.YangACL = make(map[ServiceKey][]config.ACLEntry)
+	a.YangRoute = make(map[ServiceKey][]config.OwnedRoute)
 	a.ServiceMap = make(map[ServiceKey][]EndpointKey)
-
-	subscribeStreams(a)
 }
 
-// SubscribeStreams subscribes for config notifications
-func subscribeStreams(a *Agent) {
-	ctx := context.Background()
+// subscribeStreams subscribes for config notifications, along with notifications on the state of the switch
+func subscribeStreams(ctx context.Context, a *Agent, client protos.SdkMgrServiceClient) error {
 	// Set up agent name
 	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.GetName())
 
 	notifRegReq := &protos.NotificationRegisterRequest{Op: protos.NotificationRegisterRequest_Create}
-	r3, err := a.Client.NotificationRegister(ctx, notifRegReq)
+	r3, err := client.NotificationRegister(ctx, notifRegReq)
 	if err != nil {
-		log.Fatalf("Could not register for notification : %v", err)
+		return fmt.Errorf("could not register for notification: %v", err)
 	}
 	log.Infof("Notification registration status : %s stream_id %v\n", r3.Status, r3.GetStreamId())
 
@@ -216,45 +494,115 @@ func subscribeStreams(a *Agent) {
 		StreamId:          r3.GetStreamId(),
 		SubscriptionTypes: cfgEntry,
 	}
-	r4, err := a.Client.NotificationRegister(ctx, cfgReq)
+	r4, err := client.NotificationRegister(ctx, cfgReq)
 	if err != nil {
-		log.Fatalf("Could not register for config notification : %v", err)
+		return fmt.Errorf("could not register for config notification: %v", err)
 	}
 	log.Infof("Config notification registration status : %s stream_id %v\n", r4.Status, r4.GetStreamId())
+
+	return subscribeNotifications(ctx, client, r3.GetStreamId())
 }
 
-// RunRecvNotification is called when a notification is received
-func (a *Agent) ReceiveNotifications() {
+// ReceiveNotifications receives notifications from NDK until the context is cancelled or the stream fails
+func (a *Agent) ReceiveNotifications(ctx context.Context) {
 	defer a.Wg.Done()
 
-	ctx := context.Background()
-
 	// Set up agent name
 	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.Name)
 	notifClient := protos.NewSdkNotificationServiceClient(a.GrpcConn)
 	subReq := &protos.NotificationStreamRequest{StreamId: a.StreamID}
 	stream, err := notifClient.NotificationStream(ctx, subReq)
 	if err != nil {
-		log.Fatalf("Could not subscribe for notification : %v", err)
+		// The process exits once it has been unhealthy for long enough
+		notificationStreamFailed(fmt.Errorf("could not subscribe for notifications: %v", err))
+		return
 	}
 
 	waitc := make(chan struct{})
 	go func() {
 		for {
 			in, err := stream.Recv()
+			if ctx.Err() != nil {
+				log.Infof("Stopping notification stream...")
+				close(waitc)
+				return
+			}
 			if err == io.EOF {
+				notificationStreamFailed(fmt.Errorf("notification stream closed"))
 				close(waitc)
 				return
 			}
 			if err != nil {
-				log.Fatalf("Failed to receive a notification : %v", err)
+				// The process exits once it has been unhealthy for long enough
+				log.Errorf("Failed to receive a notification : %v", err)
+				notificationStreamFailed(fmt.Errorf("failed to receive a notification: %v", err))
+				close(waitc)
+				return
 			}
+			notificationStarted()
 			HandleNotificationEvent(in, a)
+			notificationDone()
 		}
 	}()
 	<-waitc
 }
 
+// Shutdown publishes kbutler as shutting down, unregisters the agent from NDK and closes the connection to NDK.
+// Processing holding the agent lock is allowed to finish, so its telemetry is published before unregistering
+func (a *Agent) Shutdown(ctx context.Context) {
+	a.Lock()
+	defer a.Unlock()
+
+	healthMu.Lock()
+	healthStopped = true
+	a.Yang.OperState.Value = "down"
+	a.Yang.OperReason.Value = "shutting-down"
+	a.UpdateBaseTelemetry()
+	healthMu.Unlock()
+
+	if a.Standalone {
+		return
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.Name)
+	r, err := a.Client.AgentUnRegister(ctx, &protos.AgentRegistrationRequest{})
+	if err != nil {
+		log.Errorf("Could not unregister: %v", err)
+	} else {
+		log.Infof("Agent unregistration status: %s", r.GetStatus())
+	}
+	if err := a.GrpcConn.Close(); err != nil {
+		log.Errorf("Could not close the connection to NDK: %v", err)
+	}
+}
+
+// ConfigHandler is called with the agent configuration whenever it changes
+type ConfigHandler func(cfg config.AgentConfig)
+
+var (
+	configMu       sync.Mutex
+	configHandlers []ConfigHandler
+)
+
+// RegisterConfigHandler registers a handler to be called on configuration changes
+func (a *Agent) RegisterConfigHandler(handler ConfigHandler) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configHandlers = append(configHandlers, handler)
+}
+
+// configChanged applies the current configuration to the metrics and health listeners, then calls the registered configuration handlers
+func (a *Agent) configChanged() {
+	cfg := a.Config()
+	metrics.Listen(cfg.MetricsAddress.Value)
+	health.Listen(cfg.HealthAddress.Value)
+	health.SetExitTimeout(time.Duration(cfg.UnhealthyTimeout.Value) * time.Second)
+	configMu.Lock()
+	defer configMu.Unlock()
+	for _, handler := range configHandlers {
+		handler(a.Config())
+	}
+}
+
 // HandleKButlerConfigEvent handles configuration events for the .kbutler node
 func HandleKButlerConfigEvent(op protos.SdkMgrOperation, key *protos.ConfigKey, data *string, a *Agent) {
 	log.Infof("\n jspath %s keys %v", key.GetJsPath(), key.GetKeys())
@@ -268,23 +616,30 @@ func HandleKButlerConfigEvent(op protos.SdkMgrOperation, key *protos.ConfigKey,
 		if op == protos.SdkMgrOperation_Delete {
 			log.Infof("\nDelete operation")
 			a.DeleteTelemetry(&a.YangRoot)
+			a.setConfig(a.DefaultConfig)
+			a.configChanged()
+			// Deleting the root removed the health of the agent along with everything else
+			a.UpdateHealthTelemetry()
 		}
 		return
 	}
 
-	cur := config.AgentYang{}
+	// Leaves missing from the config keep their default values, leaf-lists are copied as unmarshalling reuses their backing array
+	cur := copyConfig(a.DefaultConfig)
 	// cur := &yang.Device{}
 	if err := json.Unmarshal([]byte(*data), &cur); err != nil {
 		log.Fatalf("Can not unmarshal config data: %s error %s", *data, err)
 	}
+	a.setConfig(cur)
+	a.configChanged()
 
-	log.Infof("\nkey %v", *key)
-	log.Infof("\nkey %v doing something now", *key)
+	log.Infof("\nkey %v", key)
+	log.Infof("\nkey %v doing something now", key)
 }
 
 // HandleConfigEvent handles a configuration event, calling the correct function to handle it
 func HandleConfigEvent(op protos.SdkMgrOperation, key *protos.ConfigKey, data *string, a *Agent) {
-	log.Infof("\nkey %v", *key)
+	log.Infof("\nkey %v", key)
 
 	if key.GetJsPath() != ".commit.end" {
 		a.CfgTranxMap[key.GetJsPath()] = append(a.CfgTranxMap[key.GetJsPath()], CfgTranxEntry{Op: op, Key: key, Data: data})
@@ -292,7 +647,7 @@ func HandleConfigEvent(op protos.SdkMgrOperation, key *protos.ConfigKey, data *s
 	}
 
 	for _, item := range a.CfgTranxMap[".kbutler.config-node"] {
-		log.Infof("%s", item)
+		log.Infof("%v", item)
 		// HandleKButlerConfigEvent(item.Op, item.Key, item.Data)
 	}
 
@@ -302,6 +657,7 @@ func HandleConfigEvent(op protos.SdkMgrOperation, key *protos.ConfigKey, data *s
 
 	// Delete all current candidate list.
 	a.CfgTranxMap = make(map[string][]CfgTranxEntry)
+	a.configTransactionDone()
 }
 
 // HandleNotificationEvent handles a notification event from NDK
@@ -315,8 +671,12 @@ func HandleNotificationEvent(in *protos.NotificationStreamResponse, a *Agent) {
 			} else {
 				HandleConfigEvent(resp.Op, resp.Key, nil, a)
 			}
+		case *protos.Notification_BfdSession:
+			HandleBFDSessionEvent(item.GetBfdSession(), a)
 		default:
-			log.Infof("\nGot unhandled message %s ", x)
+			if !dispatchNotification(item, a) {
+				log.Infof("\nGot unhandled message %s ", x)
+			}
 		}
 	}
 }
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	log "k8s.io/klog"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+)
+
+// BFDSessionHandler is called with the peer address and state of a BFD session when it changes
+type BFDSessionHandler func(address string, state string)
+
+var (
+	// bfdMu guards BFD session state and handlers, which are updated from the notification stream
+	bfdMu       sync.RWMutex
+	bfdSessions = make(map[string]string)
+	bfdHandlers []BFDSessionHandler
+)
+
+// RegisterBFDSessionHandler registers a handler to be called on BFD session state changes
+func (a *Agent) RegisterBFDSessionHandler(handler BFDSessionHandler) {
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	bfdHandlers = append(bfdHandlers, handler)
+}
+
+// BFDSessionState returns the state of the BFD session to a peer address, and whether a session exists
+func (a *Agent) BFDSessionState(address string) (string, bool) {
+	bfdMu.RLock()
+	defer bfdMu.RUnlock()
+	state, ok := bfdSessions[address]
+	return state, ok
+}
+
+// HandleBFDSessionEvent records the state of a BFD session, calling the registered handlers if it changed
+func HandleBFDSessionEvent(notification *protos.BfdSessionNotification, a *Agent) {
+	addr := notification.GetKey().GetDstIpAddr().GetAddr()
+	if len(addr) == 0 {
+		return
+	}
+	address := net.IP(addr).String()
+	state := strings.ToLower(notification.GetData().GetStatus().String())
+
+	bfdMu.Lock()
+	oldState, ok := bfdSessions[address]
+	if notification.GetOp() == protos.SdkMgrOperation_Delete {
+		delete(bfdSessions, address)
+		state = ""
+	} else {
+		bfdSessions[address] = state
+	}
+	handlers := append([]BFDSessionHandler{}, bfdHandlers...)
+	bfdMu.Unlock()
+
+	if ok && oldState == state {
+		return
+	}
+	log.Infof("BFD session to %s changed state from %q to %q", address, oldState, state)
+	for _, handler := range handlers {
+		handler(address, state)
+	}
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+)
+
+// registerGNMIStatus publishes the status of the connection to the gNMI server, now and whenever it changes
+func (a *Agent) registerGNMIStatus() {
+	fabric.RegisterGNMIStatusHandler(a.UpdateGNMITelemetry)
+	a.UpdateGNMITelemetry(fabric.CurrentGNMIStatus())
+}
+
+// UpdateGNMITelemetry publishes the status of the connection to the gNMI server
+func (a *Agent) UpdateGNMITelemetry(status fabric.GNMIStatus) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if healthStopped {
+		return
+	}
+
+	var connection config.GNMIConnection
+	connection.Target.Value = status.Target
+	if status.Connected {
+		connection.OperState.Value = "up"
+	} else {
+		connection.OperState.Value = "down"
+	}
+	connection.OperReason.Value = status.Reason
+	if !status.LastChange.IsZero() {
+		connection.LastChange.Value = status.LastChange.UTC().Format(time.RFC3339)
+	}
+	a.updateTelemetryData(a.YangRoot+".gnmi", connection)
+}
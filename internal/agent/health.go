@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ndkSubsystem and notificationSubsystem are the health subsystems tracked by the agent
+	ndkSubsystem          = "ndk"
+	notificationSubsystem = "notification-stream"
+	telemetrySubsystem    = "telemetry"
+	// notificationStuckTimeout is how long a notification may be handled for before the stream is considered stuck
+	notificationStuckTimeout = 30 * time.Second
+)
+
+var (
+	// notificationMu guards the state of the notification stream, which is updated by the receiving goroutine
+	notificationMu       sync.Mutex
+	notificationError    error
+	notificationHandling time.Time
+
+	// telemetryMu guards the result of the last telemetry write
+	telemetryMu    sync.Mutex
+	telemetryError error
+
+	// healthMu serializes publication of health, which stops once the agent is shutting down
+	healthMu      sync.Mutex
+	healthStopped bool
+)
+
+// keepAlive checks the agent is still registered with NDK
+func (a *Agent) keepAlive() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "agent_name", a.Name)
+	r, err := a.Client.KeepAlive(ctx, &protos.KeepAliveRequest{})
+	if err != nil {
+		return fmt.Errorf("keepalive failed: %v", err)
+	}
+	if r.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess {
+		return fmt.Errorf("keepalive status %s", r.GetStatus())
+	}
+	return nil
+}
+
+// notificationsHealthy checks the notification stream is still open, and that no notification has been handled for too long
+func notificationsHealthy() error {
+	notificationMu.Lock()
+	defer notificationMu.Unlock()
+	if notificationError != nil {
+		return notificationError
+	}
+	if !notificationHandling.IsZero() && time.Since(notificationHandling) > notificationStuckTimeout {
+		return fmt.Errorf("handling a notification for %s", time.Since(notificationHandling).Round(time.Second))
+	}
+	return nil
+}
+
+// notificationStarted and notificationDone record the handling of a notification
+func notificationStarted() {
+	notificationMu.Lock()
+	notificationHandling = time.Now()
+	notificationMu.Unlock()
+}
+
+func notificationDone() {
+	notificationMu.Lock()
+	notificationHandling = time.Time{}
+	notificationMu.Unlock()
+}
+
+// notificationStreamFailed records the notification stream has stopped
+func notificationStreamFailed(err error) {
+	notificationMu.Lock()
+	notificationError = err
+	notificationMu.Unlock()
+	health.Set(notificationSubsystem, err)
+}
+
+// telemetryWritten records the result of a telemetry write
+func telemetryWritten(err error) {
+	telemetryMu.Lock()
+	telemetryError = err
+	telemetryMu.Unlock()
+}
+
+// telemetryHealthy checks the last telemetry write succeeded.
+// It is a probe rather than set on each write, as publishing health itself writes telemetry
+func telemetryHealthy() error {
+	telemetryMu.Lock()
+	defer telemetryMu.Unlock()
+	if telemetryError != nil {
+		return fmt.Errorf("telemetry write failed: %v", telemetryError)
+	}
+	return nil
+}
+
+// registerHealth registers the subsystems tracked by the agent, publishing health whenever it changes.
+// There are none in standalone mode, where NDK isn't used
+func (a *Agent) registerHealth() {
+	health.RegisterHandler(a.UpdateHealthTelemetry)
+	if a.Standalone {
+		return
+	}
+	health.Register(ndkSubsystem, a.keepAlive)
+	health.Register(notificationSubsystem, notificationsHealthy)
+	health.Register(telemetrySubsystem, telemetryHealthy)
+}
+
+// subsystemPath returns the telemetry path for a health subsystem
+func (a *Agent) subsystemPath(name string) string {
+	return fmt.Sprintf("%s.subsystem{.name==\"%s\"}", a.YangRoot, name)
+}
+
+// UpdateHealthTelemetry publishes the oper-state of the agent along with the health of each subsystem.
+// It is called from any goroutine changing the health of a subsystem, so the agent lock is taken as for the rest of the published state
+func (a *Agent) UpdateHealthTelemetry() {
+	a.Lock()
+	defer a.Unlock()
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if healthStopped {
+		return
+	}
+
+	healthy, unhealthy := health.Healthy()
+	if healthy {
+		a.Yang.OperState.Value = "up"
+		a.Yang.OperReason.Value = ""
+	} else {
+		a.Yang.OperState.Value = "down"
+		a.Yang.OperReason.Value = "unhealthy: " + strings.Join(unhealthy, ",")
+	}
+	a.UpdateBaseTelemetry()
+
+	for name, status := range health.Subsystems() {
+		var subsystem config.Subsystem
+		subsystem.Healthy.Value = status.Healthy
+		subsystem.Reason.Value = status.Reason
+		subsystem.LastChange.Value = status.LastChange.UTC().Format(time.RFC3339)
+		a.updateTelemetryData(a.subsystemPath(name), subsystem)
+	}
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+
+	log "k8s.io/klog"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+)
+
+// Handlers for NDK notifications, called from the notification stream so they must not block
+type (
+	InterfaceHandler       func(notification *protos.InterfaceNotification)
+	LLDPNeighborHandler    func(notification *protos.LldpNeighborNotification)
+	NetworkInstanceHandler func(notification *protos.NetworkInstanceNotification)
+	RouteHandler           func(notification *protos.IpRouteNotification)
+	NextHopGroupHandler    func(notification *protos.NextHopGroupNotification)
+)
+
+var (
+	// handlersMu guards the registered handlers
+	handlersMu              sync.RWMutex
+	interfaceHandlers       []InterfaceHandler
+	lldpNeighborHandlers    []LLDPNeighborHandler
+	networkInstanceHandlers []NetworkInstanceHandler
+	routeHandlers           []RouteHandler
+	nextHopGroupHandlers    []NextHopGroupHandler
+)
+
+// subscribeNotifications subscribes for interface, LLDP neighbor, BFD session, network instance, route and next hop group notifications on a notification stream.
+// Routes are only subscribed to in the network instance external addresses are routed in
+func subscribeNotifications(ctx context.Context, client protos.SdkMgrServiceClient, streamID uint64) error {
+	routeFilter := &protos.RouteKeyPb{NetInstName: fabric.NetworkInstance}
+
+	subscriptions := map[string]*protos.NotificationRegisterRequest{
+		"interface":        {SubscriptionTypes: &protos.NotificationRegisterRequest_Intf{Intf: &protos.InterfaceSubscriptionRequest{}}},
+		"LLDP neighbor":    {SubscriptionTypes: &protos.NotificationRegisterRequest_LldpNeighbor{LldpNeighbor: &protos.LldpNeighborSubscriptionRequest{}}},
+		"BFD session":      {SubscriptionTypes: &protos.NotificationRegisterRequest_BfdSession{BfdSession: &protos.BfdSessionSubscriptionRequest{}}},
+		"network instance": {SubscriptionTypes: &protos.NotificationRegisterRequest_NwInst{NwInst: &protos.NetworkInstanceSubscriptionRequest{}}},
+		"route":            {SubscriptionTypes: &protos.NotificationRegisterRequest_Route{Route: &protos.IpRouteSubscriptionRequest{Key: routeFilter}}},
+		"next hop group":   {SubscriptionTypes: &protos.NotificationRegisterRequest_Nhg{Nhg: &protos.NextHopGroupSubscriptionRequest{}}},
+	}
+	for name, req := range subscriptions {
+		req.Op = protos.NotificationRegisterRequest_AddSubscription
+		req.StreamId = streamID
+		r, err := client.NotificationRegister(ctx, req)
+		if err != nil {
+			return fmt.Errorf("could not register for %s notification: %v", name, err)
+		}
+		log.Infof("%s notification registration status : %s stream_id %v\n", name, r.Status, r.GetStreamId())
+	}
+	return nil
+}
+
+// RegisterInterfaceHandler registers a handler to be called on interface notifications
+func (a *Agent) RegisterInterfaceHandler(handler InterfaceHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	interfaceHandlers = append(interfaceHandlers, handler)
+}
+
+// RegisterLLDPNeighborHandler registers a handler to be called on LLDP neighbor notifications
+func (a *Agent) RegisterLLDPNeighborHandler(handler LLDPNeighborHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	lldpNeighborHandlers = append(lldpNeighborHandlers, handler)
+}
+
+// RegisterNetworkInstanceHandler registers a handler to be called on network instance notifications
+func (a *Agent) RegisterNetworkInstanceHandler(handler NetworkInstanceHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	networkInstanceHandlers = append(networkInstanceHandlers, handler)
+}
+
+// RegisterRouteHandler registers a handler to be called on route notifications
+func (a *Agent) RegisterRouteHandler(handler RouteHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	routeHandlers = append(routeHandlers, handler)
+}
+
+// RegisterNextHopGroupHandler registers a handler to be called on next hop group notifications
+func (a *Agent) RegisterNextHopGroupHandler(handler NextHopGroupHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	nextHopGroupHandlers = append(nextHopGroupHandlers, handler)
+}
+
+// dispatchNotification calls the handlers registered for a notification, returning false if it is not a handled type
+func dispatchNotification(item *protos.Notification, a *Agent) bool {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	switch item.SubscriptionTypes.(type) {
+	case *protos.Notification_Intf:
+		for _, handler := range interfaceHandlers {
+			handler(item.GetIntf())
+		}
+	case *protos.Notification_LldpNeighbor:
+		for _, handler := range lldpNeighborHandlers {
+			handler(item.GetLldpNeighbor())
+		}
+	case *protos.Notification_NwInst:
+		for _, handler := range networkInstanceHandlers {
+			handler(item.GetNwInst())
+		}
+	case *protos.Notification_Route:
+		for _, handler := range routeHandlers {
+			handler(item.GetRoute())
+		}
+	case *protos.Notification_Nhg:
+		for _, handler := range nextHopGroupHandlers {
+			handler(item.GetNhg())
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// publishedState holds the data last published at each path.
+// It suppresses writes of unchanged data and backs the state served by the HTTP API
+type publishedState struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+// published is the data published by the agent
+var published = publishedState{data: make(map[string]string)}
+
+// record stores data published at a path, returning true if it is unchanged since it was last published
+func (p *publishedState) record(path string, data string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	unchanged := p.data[path] == data
+	p.data[path] = data
+	return unchanged
+}
+
+// forget removes the data published at a path along with everything below it
+func (p *publishedState) forget(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.data {
+		if key == path || strings.HasPrefix(key, path+".") {
+			delete(p.data, key)
+		}
+	}
+}
+
+// snapshot returns a copy of the data published at each path
+func (p *publishedState) snapshot() map[string]json.RawMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make(map[string]json.RawMessage, len(p.data))
+	for path, data := range p.data {
+		result[path] = json.RawMessage(data)
+	}
+	return result
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// ipAddress converts an address to its NDK representation
+func ipAddress(address string) (*protos.IpAddressPb, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &protos.IpAddressPb{Addr: ip4}, nil
+	}
+	return &protos.IpAddressPb{Addr: ip.To16()}, nil
+}
+
+// routeKey converts a prefix in a network instance to its NDK representation
+func routeKey(networkInstance string, prefix string) (*protos.RouteKeyPb, error) {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	address, err := ipAddress(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	prefixLength, _ := ipNet.Mask.Size()
+	return &protos.RouteKeyPb{
+		NetInstName: networkInstance,
+		IpPrefix:    &protos.IpAddrPrefLenPb{IpAddr: address, PrefixLength: uint32(prefixLength)},
+	}, nil
+}
+
+// ProgramRoute adds or updates a route to a prefix via a next hop group containing nextHops, resolved over indirect routes
+func (a *Agent) ProgramRoute(networkInstance string, prefix string, nextHopGroup string, nextHops []string) error {
+	// Routes are programmed through NDK
+	if a.Standalone {
+		return errStandalone
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "agent_name", a.Name)
+
+	key, err := routeKey(networkInstance, prefix)
+	if err != nil {
+		return err
+	}
+	group := &protos.NextHopGroup{}
+	for _, nextHop := range nextHops {
+		address, err := ipAddress(nextHop)
+		if err != nil {
+			return err
+		}
+		group.NextHop = append(group.NextHop, &protos.NextHop{
+			ResolveTo: protos.NextHop_INDIRECT,
+			Type:      protos.NextHop_REGULAR,
+			Nexthop:   &protos.NextHop_IpNexthop{IpNexthop: address},
+		})
+	}
+
+	nhgClient := protos.NewSdkMgrNextHopGroupServiceClient(a.GrpcConn)
+	nhgReq := &protos.NextHopGroupRequest{GroupInfo: []*protos.NextHopGroupInfo{{
+		Key:  &protos.NextHopGroupKey{Name: nextHopGroup, NetworkInstanceName: networkInstance},
+		Data: group,
+	}}}
+	nhgResp, err := nhgClient.NextHopGroupAddOrUpdate(ctx, nhgReq)
+	if err != nil {
+		return err
+	}
+	if nhgResp.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess {
+		return fmt.Errorf("next hop group add/update failed: %s", nhgResp.GetErrorStr())
+	}
+
+	routeClient := protos.NewSdkMgrRouteServiceClient(a.GrpcConn)
+	routeReq := &protos.RouteAddRequest{Routes: []*protos.RouteInfo{{
+		Key:  key,
+		Data: &protos.RoutePb{NexthopGroupName: nextHopGroup},
+	}}}
+	routeResp, err := routeClient.RouteAddOrUpdate(ctx, routeReq)
+	if err != nil {
+		return err
+	}
+	if routeResp.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess {
+		return fmt.Errorf("route add/update failed: %s", routeResp.GetErrorStr())
+	}
+	return nil
+}
+
+// RemoveRoute deletes a route to a prefix, followed by its next hop group
+func (a *Agent) RemoveRoute(networkInstance string, prefix string, nextHopGroup string) error {
+	// Routes are programmed through NDK
+	if a.Standalone {
+		return errStandalone
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "agent_name", a.Name)
+
+	key, err := routeKey(networkInstance, prefix)
+	if err != nil {
+		return err
+	}
+	routeClient := protos.NewSdkMgrRouteServiceClient(a.GrpcConn)
+	routeResp, err := routeClient.RouteDelete(ctx, &protos.RouteDeleteRequest{Routes: []*protos.RouteKeyPb{key}})
+	if err != nil {
+		return err
+	}
+	if routeResp.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess {
+		return fmt.Errorf("route delete failed: %s", routeResp.GetErrorStr())
+	}
+
+	nhgClient := protos.NewSdkMgrNextHopGroupServiceClient(a.GrpcConn)
+	nhgReq := &protos.NextHopGroupDeleteRequest{GroupKey: []*protos.NextHopGroupKey{{Name: nextHopGroup, NetworkInstanceName: networkInstance}}}
+	nhgResp, err := nhgClient.NextHopGroupDelete(ctx, nhgReq)
+	if err != nil {
+		return err
+	}
+	if nhgResp.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess {
+		return fmt.Errorf("next hop group delete failed: %s", nhgResp.GetErrorStr())
+	}
+	return nil
+}
+
+// RoutePrefix returns the prefix of a route key, in the form used by the route table
+func RoutePrefix(key *protos.RouteKeyPb) string {
+	return fmt.Sprintf("%s/%d", net.IP(key.GetIpPrefix().GetIpAddr().GetAddr()).String(), key.GetIpPrefix().GetPrefixLength())
+}
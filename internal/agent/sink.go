@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+
+	log "k8s.io/klog"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// TelemetrySink publishes the state of the agent, keyed by the path of each YANG node
+type TelemetrySink interface {
+	// Update publishes JSON encoded data at a path
+	Update(path string, data string) error
+	// Delete removes the data at a path along with everything below it
+	Delete(path string) error
+}
+
+// ndkSink publishes state as NDK telemetry, merging it into the state of the switch
+type ndkSink struct {
+	a *Agent
+}
+
+func (s ndkSink) Update(path string, data string) error {
+	// Set up agent name
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "agent_name", s.a.Name)
+	telClient := protos.NewSdkMgrTelemetryServiceClient(s.a.GrpcConn)
+
+	key := &protos.TelemetryKey{JsPath: path}
+	entry := &protos.TelemetryInfo{Key: key, Data: &protos.TelemetryData{JsonContent: data}}
+	telReq := &protos.TelemetryUpdateRequest{State: []*protos.TelemetryInfo{entry}}
+
+	start := time.Now()
+	result, err := telClient.TelemetryAddOrUpdate(ctx, telReq)
+	metrics.ObserveTelemetry("update", start, err != nil || result.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess)
+	if err != nil {
+		return err
+	}
+	log.Infof("Telemetry add/update status: %s error_string: %s", result.GetStatus(), result.GetErrorStr())
+	return nil
+}
+
+func (s ndkSink) Delete(path string) error {
+	// Set up agent name
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "agent_name", s.a.Name)
+	telClient := protos.NewSdkMgrTelemetryServiceClient(s.a.GrpcConn)
+
+	telReq := &protos.TelemetryDeleteRequest{Key: []*protos.TelemetryKey{{JsPath: path}}}
+
+	start := time.Now()
+	r1, err := telClient.TelemetryDelete(ctx, telReq)
+	metrics.ObserveTelemetry("delete", start, err != nil || r1.GetStatus() != protos.SdkMgrStatus_kSdkMgrSuccess)
+	if err != nil {
+		return err
+	}
+	log.Infof("Telemetry delete status: %s error_string: %s", r1.GetStatus(), r1.GetErrorStr())
+	return nil
+}
+
+// APISink keeps state only within the agent, where it is served by the HTTP API.
+// It is used in standalone mode, where there is no NDK to publish to
+type APISink struct{}
+
+func (APISink) Update(path string, data string) error {
+	log.V(2).Infof("Telemetry update of %s: %s", path, data)
+	return nil
+}
+
+func (APISink) Delete(path string) error {
+	log.V(2).Infof("Telemetry delete of %s", path)
+	return nil
+}
+
+// updateTelemetryData marshals data and publishes it at the specified path, suppressing writes of unchanged data.
+// Failures are recorded in the health of the telemetry subsystem, the data being published again on its next update
+func (a *Agent) updateTelemetryData(jsPath string, data interface{}) error {
+	jsData, err := json.Marshal(data)
+	if err != nil {
+		log.Errorf("Can not marshal telemetry data for key %s: %v", jsPath, err)
+		return err
+	}
+	jsString := string(jsData)
+	unchanged := published.record(jsPath, jsString)
+	metrics.TelemetryWrite(unchanged)
+	if unchanged {
+		return nil
+	}
+	err = a.Sink.Update(jsPath, jsString)
+	if err != nil {
+		log.Errorf("Could not update telemetry for key %s: %v", jsPath, err)
+		published.forget(jsPath)
+	}
+	telemetryWritten(err)
+	return err
+}
+
+// DeleteTelemetry deletes the data published at the specified path
+func (a *Agent) DeleteTelemetry(JsPath *string) error {
+	// Deleting a path deletes everything below it
+	published.forget(*JsPath)
+	err := a.Sink.Delete(*JsPath)
+	if err != nil {
+		log.Errorf("Could not delete telemetry for key %s: %v", *JsPath, err)
+	}
+	telemetryWritten(err)
+	return err
+}
+
+// Telemetry returns the data published at each path
+func (a *Agent) Telemetry() map[string]json.RawMessage {
+	return published.snapshot()
+}
+
+// errStandalone is returned by operations only available through NDK
+var errStandalone = fmt.Errorf("not available in standalone mode")
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+
+	log "k8s.io/klog"
+)
+
+const (
+	// Startup phases, completed in order before kbutler starts processing. In standalone mode
+	// gnmi-connected replaces ndk-registered, and configuration is not received
+	PhaseNDKRegistered   = "ndk-registered"
+	PhaseGNMIConnected   = "gnmi-connected"
+	PhaseConfigReceived  = "config-received"
+	PhaseKubernetesReady = "kubernetes-client-ready"
+	PhaseCachesSynced    = "caches-synced"
+
+	// Startup phase states
+	PhasePending  = "pending"
+	PhaseFailed   = "failed"
+	PhaseComplete = "complete"
+
+	// CacheSyncTimeout is how long managers wait for their informer caches to synchronize before recording a failure and waiting again
+	CacheSyncTimeout = 2 * time.Minute
+)
+
+var (
+	// phasesMu guards the state of each startup phase, which is published once the agent is registered with NDK
+	phasesMu sync.Mutex
+	phases   = map[string]*config.StartupPhase{}
+
+	// configReceived is closed once the first configuration transaction has been handled
+	configReceived     = make(chan struct{})
+	configReceivedOnce sync.Once
+)
+
+// phasePath returns the telemetry path for a startup phase
+func (a *Agent) phasePath(name string) string {
+	return fmt.Sprintf("%s.startup_phase{.name==\"%s\"}", a.YangRoot, name)
+}
+
+// SetPhase records the state of a startup phase, publishing it once the agent has a sink
+func (a *Agent) SetPhase(name string, state string, reason string) {
+	phasesMu.Lock()
+	defer phasesMu.Unlock()
+	phase, ok := phases[name]
+	if ok && phase.State.Value == state && phase.Reason.Value == reason {
+		return
+	}
+	if state == PhaseFailed {
+		log.Errorf("Startup phase %s failed: %s", name, reason)
+	} else {
+		log.Infof("Startup phase %s is %s", name, state)
+	}
+	phase = &config.StartupPhase{}
+	phase.State.Value = state
+	phase.Reason.Value = reason
+	phase.LastChange.Value = time.Now().UTC().Format(time.RFC3339)
+	phases[name] = phase
+	if a.Sink != nil {
+		a.updateTelemetryData(a.phasePath(name), phase)
+	}
+}
+
+// publishPhases publishes the state of each startup phase recorded before the agent had a sink
+func (a *Agent) publishPhases() {
+	phasesMu.Lock()
+	defer phasesMu.Unlock()
+	for name, phase := range phases {
+		a.updateTelemetryData(a.phasePath(name), phase)
+	}
+}
+
+// ConfigReceived returns a channel closed once the initial configuration has been received from NDK
+func (a *Agent) ConfigReceived() <-chan struct{} {
+	return configReceived
+}
+
+// configTransactionDone records a configuration transaction has been handled
+func (a *Agent) configTransactionDone() {
+	configReceivedOnce.Do(func() {
+		close(configReceived)
+		a.SetPhase(PhaseConfigReceived, PhaseComplete, "")
+	})
+}
+
+// SyncCaches runs sync until the caches of a manager are synchronized, recording each failure against the caches-synced phase.
+// It returns false if the context is cancelled first
+func (a *Agent) SyncCaches(ctx context.Context, name string, sync func() error) bool {
+	for {
+		err := sync()
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		a.SetPhase(PhaseCachesSynced, PhaseFailed, fmt.Sprintf("%s: %v", name, err))
+	}
+}
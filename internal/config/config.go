@@ -18,8 +18,69 @@ type Name struct {
 	Value string `json:"value"`
 }
 
+type Flag struct {
+	Value bool `json:"value"`
+}
+
+type Seconds struct {
+	Value uint32 `json:"value"`
+}
+
+type Port struct {
+	Value uint32 `json:"value"`
+}
+
+type Microseconds struct {
+	Value uint32 `json:"value"`
+}
+
+type Multiplier struct {
+	Value uint32 `json:"value"`
+}
+
+type Counter struct {
+	Value uint64 `json:"value"`
+}
+
+// ServicePort is a port exposed by a service, keyed by port and protocol
+type ServicePort struct {
+	Port       int32  `json:"-"`
+	Protocol   string `json:"-"`
+	Name       Name   `json:"name"`
+	TargetPort Name   `json:"target_port"`
+	NodePort   Port   `json:"node_port"`
+}
+
+// Metadata is a label or annotation value published against a service
+type Metadata struct {
+	Value Name `json:"value"`
+}
+
+// PodCIDR is the state of the route for a pod CIDR of a node, keyed by prefix
+type PodCIDR struct {
+	Prefix         string           `json:"-"`
+	RoutePresent   Flag             `json:"route_present"`
+	FIBProgrammed  ProgrammingState `json:"fib_programmed"`
+	NextHopMatches Flag             `json:"next_hop_matches"`
+	OperState      OperState        `json:"oper_state"`
+	OperReason     OperState        `json:"oper_reason"`
+}
+
+// NodeInterface is an interface of this switch a node is attached to, learnt via LLDP, keyed by interface name
+type NodeInterface struct {
+	Name       string    `json:"-"`
+	ChassisID  Name      `json:"chassis_id"`
+	SystemName Name      `json:"system_name"`
+	PortID     Name      `json:"port_id"`
+	MatchedBy  Name      `json:"matched_by"`
+	OperState  OperState `json:"oper_state"`
+}
+
 type Node struct {
 	Address Address `json:"address"`
+	// Pod CIDRs and interfaces are published under their own paths
+	PodCIDR   []PodCIDR       `json:"-"`
+	Interface []NodeInterface `json:"-"`
 	// Hostname Name    `json:"hostname"`
 	// Hostname string `json:"hostname"`
 	// NextHop struct {
@@ -27,12 +88,48 @@ type Node struct {
 	// } `json:"next_hop"`
 }
 
+// ACLEntry is an entry rendered into a switch ACL for a service, keyed by sequence id
+type ACLEntry struct {
+	SequenceID        uint32  `json:"-"`
+	Filter            Name    `json:"filter"`
+	Description       Name    `json:"description"`
+	SourcePrefix      Address `json:"source_prefix"`
+	DestinationPrefix Address `json:"destination_prefix"`
+	Protocol          Name    `json:"protocol"`
+	DestinationPort   Port    `json:"destination_port"`
+	Action            Name    `json:"action"`
+	Applied           Flag    `json:"applied"`
+	MatchedPackets    Counter `json:"matched_packets"`
+}
+
+// OwnedRoute is a route to an external address programmed by kbutler, keyed by prefix
+type OwnedRoute struct {
+	Prefix       string    `json:"-"`
+	NextHopGroup Name      `json:"next_hop_group"`
+	NextHops     Name      `json:"next_hops"`
+	Programmed   Flag      `json:"programmed"`
+	OperReason   OperState `json:"oper_reason"`
+}
+
+// BackendPod is a pod backing a service on a host, keyed by namespace and name
+type BackendPod struct {
+	Name      string  `json:"-"`
+	Namespace string  `json:"-"`
+	Address   Address `json:"address"`
+	Ready     Flag    `json:"ready"`
+	Ports     Name    `json:"ports"`
+}
+
 type Endpoint struct {
 	// Node map[string]Node `json:"node"`
 	OperState     OperState        `json:"oper_state"`
 	OperReason    OperState        `json:"oper_reason"`
 	FIBProgrammed ProgrammingState `json:"fib_programmed"`
 	HostAddress   Address          `json:"host_address"`
+	// NotReady is set when the host only has pods that are not ready, so it is not expected to be a next hop
+	NotReady Flag `json:"not_ready"`
+	// Pods are published under their own paths
+	Pod []BackendPod `json:"-"`
 	// Address Address         `json:"address"`
 	// Address string `json:"address"`
 	// NextHops struct {
@@ -42,8 +139,18 @@ type Endpoint struct {
 
 type Service struct {
 	// ExternalAddress map[string]ExternalAddress `json:"external_address"`
-	OperState  OperState `json:"oper_state"`
-	OperReason OperState `json:"oper_reason"`
+	OperState             OperState `json:"oper_state"`
+	OperReason            OperState `json:"oper_reason"`
+	Type                  Name      `json:"type"`
+	LoadBalancerClass     Name      `json:"load_balancer_class"`
+	ExternalTrafficPolicy Name      `json:"external_traffic_policy"`
+	HealthCheckNodePort   Port      `json:"health_check_node_port"`
+	RequestedAddress      Address   `json:"requested_address"`
+	// Lists below are published under their own paths
+	Port       []ServicePort     `json:"-"`
+	Ingress    []string          `json:"-"`
+	Label      map[string]string `json:"-"`
+	Annotation map[string]string `json:"-"`
 	// Name            Name                       `json:"name"`
 	// Name string `json:"name"`
 }
@@ -56,7 +163,81 @@ type Namespace struct {
 
 // AgentYang holds the YANG schema for the agent
 type AgentYang struct {
-	Controller Address `json:"controller"`
+	Controller Address   `json:"controller"`
+	OperState  OperState `json:"oper_state"`
+	OperReason OperState `json:"oper_reason"`
+}
+
+// StartupPhase is the state of a phase of starting the agent, keyed by name
+type StartupPhase struct {
+	State      OperState `json:"state"`
+	Reason     OperState `json:"reason"`
+	LastChange Name      `json:"last_change"`
+}
+
+// Subsystem is the health of a part of the agent, keyed by name
+type Subsystem struct {
+	Healthy    Flag      `json:"healthy"`
+	Reason     OperState `json:"reason"`
+	LastChange Name      `json:"last_change"`
+}
+
+// GNMIConnection is the status of the connection to the gNMI server
+type GNMIConnection struct {
+	Target     Address   `json:"target"`
+	OperState  OperState `json:"oper_state"`
+	OperReason OperState `json:"oper_reason"`
+	LastChange Name      `json:"last_change"`
+}
+
+// AgentConfig holds the configurable leaves of the agent
+type AgentConfig struct {
+	PendingTimeout     Seconds `json:"pending_timeout"`
+	ServiceAnnotations Flag    `json:"service_annotations"`
+	// ManageNetworkUnavailable clears NodeNetworkUnavailable once the fabric routes a node's pod CIDRs
+	ManageNetworkUnavailable Flag `json:"manage_network_unavailable"`
+	// NetworkPolicyACL is one of disabled, dry-run or enabled
+	NetworkPolicyACL Name `json:"network_policy_acl"`
+	// ACLSubinterfaces lists the subinterfaces, as interface.index, the filters protecting external addresses are bound to
+	ACLSubinterfaces []Name `json:"acl_subinterface"`
+	// ProgramRoutes makes kbutler the source of routes to external addresses, via the nodes backing each service
+	ProgramRoutes Flag `json:"program_routes"`
+	// BFD folds the state of BFD sessions to nodes backing services into their external address state
+	BFD                 Flag         `json:"bfd"`
+	BFDMinTransmit      Microseconds `json:"bfd_min_transmit"`
+	BFDMinReceive       Microseconds `json:"bfd_min_receive"`
+	BFDDetectMultiplier Multiplier   `json:"bfd_detect_multiplier"`
+	// NodeLabels labels nodes attached to this switch with their fabric placement, along with Rack if set
+	NodeLabels Flag `json:"node_labels"`
+	Rack       Name `json:"rack"`
+	// MetricsAddress is the address Prometheus metrics are served on, empty disables the listener
+	MetricsAddress Address `json:"metrics_address"`
+	// APIAddress is the address the read-only state API is served on, empty disables the listener
+	APIAddress Address `json:"api_address"`
+	// HealthAddress is the address liveness and readiness checks are served on, empty disables the listener
+	HealthAddress Address `json:"health_address"`
+	// UnhealthyTimeout is how long the agent may stay unhealthy before exiting, 0 disables this
+	UnhealthyTimeout Seconds `json:"unhealthy_timeout"`
+	// PublishedMetadata lists the label and annotation keys published against services, entries ending in / match any key with that prefix
+	PublishedMetadata []Name `json:"published_metadata"`
+}
+
+// DefaultAgentConfig returns the configuration used by the agent until it is configured
+func DefaultAgentConfig() AgentConfig {
+	return AgentConfig{
+		PendingTimeout:      Seconds{Value: 300},
+		ServiceAnnotations:  Flag{Value: true},
+		NetworkPolicyACL:    Name{Value: "disabled"},
+		BFDMinTransmit:      Microseconds{Value: 1000000},
+		BFDMinReceive:       Microseconds{Value: 1000000},
+		BFDDetectMultiplier: Multiplier{Value: 3},
+		UnhealthyTimeout:    Seconds{Value: 300},
+		PublishedMetadata: []Name{
+			{Value: "app"},
+			{Value: "app.kubernetes.io/"},
+			{Value: "metallb.universe.tf/"},
+		},
+	}
 }
 
 // func (ay *AgentYang) AddNamespace(name string, service struct{}) {
@@ -0,0 +1,190 @@
+package endpointmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+
+	log "k8s.io/klog"
+)
+
+// bfdOwner is a node address backing a service, reachable over a subinterface BFD is enabled on
+type bfdOwner struct {
+	ServiceKey  agent.ServiceKey
+	NodeAddress string
+}
+
+// bfdSubinterface is the BFD configuration of a subinterface facing nodes
+type bfdSubinterface struct {
+	timers fabric.BFDTimers
+	// configured is set when kbutler created the configuration, BFD configured by others is never changed or removed
+	configured bool
+	owners     map[bfdOwner]bool
+}
+
+var (
+	// bfdMu guards bfdSubinterfaces
+	bfdMu sync.Mutex
+	// bfdSubinterfaces holds the subinterfaces facing nodes BFD is needed on, keyed by subinterface
+	bfdSubinterfaces = make(map[string]*bfdSubinterface)
+	// bfdOwnedFile records the subinterfaces kbutler configured BFD on, as the BFD configuration has no field to mark them with.
+	// It survives restarts, so BFD created before a restart is still updated and removed by kbutler
+	bfdOwnedFile = "/etc/opt/srlinux/kbutler/bfd-subinterfaces.json"
+)
+
+// restoreBFD tracks the subinterfaces recorded in bfdOwnedFile as configured by kbutler, without any owners.
+// Timers are unknown, so they are set again once a service needs the subinterface
+func restoreBFD() {
+	data, err := ioutil.ReadFile(bfdOwnedFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to read BFD subinterfaces configured by kbutler: %v", err)
+		return
+	}
+	var subinterfaces []string
+	if err := json.Unmarshal(data, &subinterfaces); err != nil {
+		log.Errorf("Failed to parse BFD subinterfaces configured by kbutler: %s: %v", bfdOwnedFile, err)
+		return
+	}
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	for _, subinterface := range subinterfaces {
+		if _, ok := bfdSubinterfaces[subinterface]; !ok {
+			log.Infof("Restoring BFD configured by kbutler on subinterface: %s", subinterface)
+			bfdSubinterfaces[subinterface] = &bfdSubinterface{configured: true, owners: make(map[bfdOwner]bool)}
+		}
+	}
+}
+
+// saveBFD records the subinterfaces kbutler configured BFD on in bfdOwnedFile, replacing it atomically. bfdMu must be held
+func saveBFD() {
+	subinterfaces := []string{}
+	for subinterface, current := range bfdSubinterfaces {
+		if current.configured {
+			subinterfaces = append(subinterfaces, subinterface)
+		}
+	}
+	sort.Strings(subinterfaces)
+	data, err := json.Marshal(subinterfaces)
+	if err == nil {
+		tmp := bfdOwnedFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, bfdOwnedFile)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to record BFD subinterfaces configured by kbutler in %s: %v", filepath.Dir(bfdOwnedFile), err)
+	}
+}
+
+// releaseUnownedBFD removes the BFD configuration kbutler created on subinterfaces no service needs,
+// once the endpoints of all services have been processed after a restart
+func releaseUnownedBFD() {
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	for subinterface, current := range bfdSubinterfaces {
+		if len(current.owners) == 0 {
+			removeBFD(Ctx, subinterface, current)
+		}
+	}
+}
+
+// configureBFD enables BFD with the configured timers on the subinterface a node backing a service is reachable over,
+// unless BFD is already configured there by others
+func configureBFD(serviceKey agent.ServiceKey, nodeAddress string) {
+	iface, index, found, err := fabric.Neighbor(nodeAddress)
+	if err != nil || !found {
+		return
+	}
+	subinterface := fmt.Sprintf("%s.%s", iface, index)
+	cfg := KButler.Config()
+	timers := fabric.BFDTimers{
+		MinTransmit:      cfg.BFDMinTransmit.Value,
+		MinReceive:       cfg.BFDMinReceive.Value,
+		DetectMultiplier: cfg.BFDDetectMultiplier.Value,
+	}
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	current, ok := bfdSubinterfaces[subinterface]
+	if !ok {
+		configured, err := fabric.BFDSubinterfaceConfigured(subinterface)
+		if err != nil {
+			log.Errorf("Failed to check BFD configuration of subinterface: %s: %v", subinterface, err)
+			return
+		}
+		if configured {
+			log.Infof("BFD is already configured on subinterface: %s, leaving it untouched", subinterface)
+		}
+		// Subinterfaces configured by others are tracked to avoid checking them again
+		current = &bfdSubinterface{configured: !configured, owners: make(map[bfdOwner]bool)}
+		bfdSubinterfaces[subinterface] = current
+	}
+	current.owners[bfdOwner{ServiceKey: serviceKey, NodeAddress: nodeAddress}] = true
+	if !current.configured || (ok && current.timers == timers) {
+		return
+	}
+	log.Infof("Enabling BFD on subinterface: %s, towards node address: %s, timers: %+v", subinterface, nodeAddress, timers)
+	// The subinterface is recorded before configuring it, so a restart in between still finds it owned
+	if !ok {
+		saveBFD()
+	}
+	if err := fabric.SetBFDSubinterface(Ctx, subinterface, timers); err != nil {
+		log.Errorf("Failed to enable BFD on subinterface: %s: %v", subinterface, err)
+		// The configuration is retried the next time the service is processed
+		current.timers = fabric.BFDTimers{}
+		return
+	}
+	current.timers = timers
+}
+
+// releaseBFD drops the need of a service for BFD towards nodes other than nodeAddresses,
+// removing the BFD configuration kbutler created on subinterfaces no longer facing nodes backing any service
+func releaseBFD(serviceKey agent.ServiceKey, nodeAddresses []string) {
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	for subinterface, current := range bfdSubinterfaces {
+		for owner := range current.owners {
+			if owner.ServiceKey == serviceKey && !fabric.ContainsAddress(nodeAddresses, owner.NodeAddress) {
+				delete(current.owners, owner)
+			}
+		}
+		if len(current.owners) == 0 {
+			removeBFD(Ctx, subinterface, current)
+		}
+	}
+}
+
+// releaseAllBFD removes all BFD configuration kbutler created, once BFD is disabled or kbutler shuts down
+func releaseAllBFD(ctx context.Context) {
+	bfdMu.Lock()
+	defer bfdMu.Unlock()
+	for subinterface, current := range bfdSubinterfaces {
+		removeBFD(ctx, subinterface, current)
+	}
+}
+
+// removeBFD stops tracking a subinterface, removing its BFD configuration if kbutler created it. bfdMu must be held
+func removeBFD(ctx context.Context, subinterface string, current *bfdSubinterface) {
+	if current.configured {
+		log.Infof("Removing BFD from subinterface: %s", subinterface)
+		if err := fabric.DeleteBFDSubinterface(ctx, subinterface); err != nil {
+			// The removal is retried the next time BFD is released
+			log.Errorf("Failed to remove BFD from subinterface: %s: %v", subinterface, err)
+			return
+		}
+	}
+	delete(bfdSubinterfaces, subinterface)
+	if current.configured {
+		saveBFD()
+	}
+}
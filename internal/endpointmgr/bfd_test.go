@@ -0,0 +1,58 @@
+package endpointmgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+)
+
+func TestRestoreBFD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kbutler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) {
+		bfdOwnedFile = file
+		bfdSubinterfaces = make(map[string]*bfdSubinterface)
+	}(bfdOwnedFile)
+	bfdOwnedFile = filepath.Join(dir, "bfd-subinterfaces.json")
+
+	// Nothing is restored before kbutler configured BFD anywhere
+	bfdSubinterfaces = make(map[string]*bfdSubinterface)
+	restoreBFD()
+	if len(bfdSubinterfaces) != 0 {
+		t.Fatalf("restoreBFD() without a file tracked %d subinterfaces", len(bfdSubinterfaces))
+	}
+
+	owner := bfdOwner{ServiceKey: agent.ServiceKey{Namespace: "default", Name: "web"}, NodeAddress: "192.0.2.1"}
+	bfdSubinterfaces = map[string]*bfdSubinterface{
+		"ethernet-1/1.0": {configured: true, timers: fabric.BFDTimers{MinTransmit: 1000000}, owners: map[bfdOwner]bool{owner: true}},
+		"ethernet-1/2.0": {configured: true, owners: map[bfdOwner]bool{owner: true}},
+		"ethernet-1/3.0": {configured: false, owners: map[bfdOwner]bool{owner: true}},
+	}
+	bfdMu.Lock()
+	saveBFD()
+	bfdMu.Unlock()
+
+	// After a restart, only the subinterfaces kbutler configured are tracked, with no owners or timers yet
+	bfdSubinterfaces = make(map[string]*bfdSubinterface)
+	restoreBFD()
+	var restored []string
+	for subinterface, current := range bfdSubinterfaces {
+		if !current.configured || len(current.owners) != 0 || current.timers != (fabric.BFDTimers{}) {
+			t.Errorf("restored subinterface %s = %+v, want configured without owners or timers", subinterface, current)
+		}
+		restored = append(restored, subinterface)
+	}
+	sort.Strings(restored)
+	if want := []string{"ethernet-1/1.0", "ethernet-1/2.0"}; !reflect.DeepEqual(restored, want) {
+		t.Errorf("restoreBFD() restored %v, want %v", restored, want)
+	}
+}
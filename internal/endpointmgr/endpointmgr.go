@@ -3,58 +3,131 @@ package endpointmgr
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/brwallis/srlinux-go/pkg/gnmi"
-	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
 	"github.com/brwallis/srlinux-kbutler/internal/agent"
 	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+	"github.com/brwallis/srlinux-kbutler/internal/nodemgr"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
 
 	log "k8s.io/klog"
 
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	yangRoot = ".kbutler"
+	// standaloneReconcileInterval is how often the endpoints of all services are processed again in standalone mode,
+	// where there are no notifications of changes on the switch
+	standaloneReconcileInterval = 30 * time.Second
+	// bfdShutdownTimeout bounds the removal of the BFD configuration kbutler created when shutting down
+	bfdShutdownTimeout = 5 * time.Second
 )
 
 var (
 	KButler   *agent.Agent
 	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+
+	// podLister, serviceLister and nodeLister read from the caches shared with the informers of the endpoint controller
+	podLister     corelisters.PodLister
+	serviceLister corelisters.ServiceLister
+	nodeLister    corelisters.NodeLister
+
+	// externalPrefixes maps the host prefix of each external address to its service, used to filter route notifications
+	externalPrefixes   = make(map[string]agent.ServiceKey)
+	externalPrefixesMu sync.RWMutex
+	// routeViews holds the route to each external address as last seen, keyed by prefix
+	routeViews   = make(map[string]RouteView)
+	routeViewsMu sync.RWMutex
 )
 
+// RouteView is the route to an external address of a service as last seen on this switch,
+// along with the next hops expected from the nodes backing the service
+type RouteView struct {
+	Namespace        string    `json:"namespace"`
+	Service          string    `json:"service"`
+	ExternalAddress  string    `json:"external_address"`
+	Prefix           string    `json:"prefix"`
+	RouteMatched     bool      `json:"route_matched"`
+	RouteProgrammed  bool      `json:"route_programmed"`
+	NextHops         []string  `json:"next_hops"`
+	ExpectedNextHops []string  `json:"expected_next_hops"`
+	MissingNextHops  []string  `json:"missing_next_hops"`
+	Updated          time.Time `json:"updated"`
+}
+
+// RouteViews returns the route to each external address as last seen, keyed by prefix
+func RouteViews() map[string]RouteView {
+	routeViewsMu.RLock()
+	defer routeViewsMu.RUnlock()
+	views := make(map[string]RouteView, len(routeViews))
+	for prefix, view := range routeViews {
+		views[prefix] = view
+	}
+	return views
+}
+
 // EndpointController struct
 type EndpointController struct {
 	informerFactory  informers.SharedInformerFactory
 	endpointInformer coreinformers.EndpointsInformer
+	podInformer      coreinformers.PodInformer
+	serviceInformer  coreinformers.ServiceInformer
+	nodeInformer     coreinformers.NodeInformer
+	// pending holds the services to reprocess after changes in the cluster or on the switch, coalescing changes made while they wait.
+	// Services are only processed by the EndpointMgr loop, so the endpoints of a service are never processed concurrently
+	pending   map[agent.ServiceKey]bool
+	pendingMu sync.Mutex
+	trigger   chan struct{}
 }
 
-// getExternalIPForService takes a service name and namespace, and returns the external IP address
-func getExternalIPForService(serviceName string, namespace string) string {
-	var externalAddress string
-	service, err := ClientSet.CoreV1().Services(namespace).Get(context.Background(), serviceName, metav1.GetOptions{})
+// getService takes a service name and namespace, and returns the service from the informer cache, or nil if it doesn't exist
+func getService(serviceName string, namespace string) *v1.Service {
+	service, err := serviceLister.Services(namespace).Get(serviceName)
 	if err != nil {
-		log.Errorf("Error retrieving service with name: %s, %e", serviceName, err)
+		if !errors.IsNotFound(err) {
+			log.Errorf("Error retrieving service with name: %s, %v", serviceName, err)
+		}
+		return nil
 	}
+	return service
+}
 
+// getExternalIPForService takes a service, and returns the external IP address
+func getExternalIPForService(service *v1.Service) string {
+	var externalAddress string
+	if service == nil {
+		return externalAddress
+	}
 	for _, ingress := range service.Status.LoadBalancer.Ingress {
 		externalAddress = ingress.IP
 	}
 	return externalAddress
 }
 
-// getIPFromNodeName takes a node name and a K8s clientset and queries the API server for the internalIP of the node
+// getIPFromNodeName takes a node name and returns the internalIP of the node from the informer cache
 func getIPFromNodeName(nodeName string) string {
 	var nodeAddress v1.NodeAddress
-	node, err := ClientSet.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	node, err := nodeLister.Get(nodeName)
 	if err != nil {
-		log.Errorf("Error retrieving node with name: %s, %e", nodeName, err)
+		log.Errorf("Error retrieving node with name: %s, %v", nodeName, err)
+		return ""
 	}
 
 	for _, address := range node.Status.Addresses {
@@ -67,6 +140,204 @@ func getIPFromNodeName(nodeName string) string {
 	return nodeAddress.Address
 }
 
+// bfdSessionChanged reprocesses the endpoints of all services with an external address via a node whose BFD session changed
+func (c *EndpointController) bfdSessionChanged(address string, state string) {
+	var serviceKeys []agent.ServiceKey
+	KButler.RLock()
+	for serviceKey, endpointKeys := range KButler.ServiceMap {
+		for _, endpointKey := range endpointKeys {
+			if endpointData, ok := KButler.YangEndpoint[endpointKey]; ok && endpointData.HostAddress.Value == address {
+				serviceKeys = append(serviceKeys, serviceKey)
+				break
+			}
+		}
+	}
+	KButler.RUnlock()
+	c.queueReprocess(serviceKeys...)
+}
+
+// routeChanged reprocesses the endpoints of the service owning a route, if any, when the route changes on the switch
+func (c *EndpointController) routeChanged(notification *protos.IpRouteNotification) {
+	externalPrefixesMu.RLock()
+	serviceKey, ok := externalPrefixes[agent.RoutePrefix(notification.GetKey())]
+	externalPrefixesMu.RUnlock()
+	if !ok {
+		return
+	}
+	c.queueReprocess(serviceKey)
+}
+
+// queueReprocess queues services to be reprocessed, without blocking as it is called from informer handlers and the notification stream
+func (c *EndpointController) queueReprocess(serviceKeys ...agent.ServiceKey) {
+	if len(serviceKeys) == 0 {
+		return
+	}
+	c.pendingMu.Lock()
+	for _, serviceKey := range serviceKeys {
+		c.pending[serviceKey] = true
+	}
+	c.pendingMu.Unlock()
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// processPending reprocesses the queued services
+func (c *EndpointController) processPending() {
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = make(map[agent.ServiceKey]bool)
+	c.pendingMu.Unlock()
+	for serviceKey := range pending {
+		c.reprocess(serviceKey)
+	}
+}
+
+// processAll processes the endpoints of all services known to the informer, returning false if they could not be listed
+func (c *EndpointController) processAll() bool {
+	endpoints, err := c.endpointInformer.Lister().List(labels.Everything())
+	if err != nil {
+		log.Errorf("Failed to list endpoints: %v", err)
+		return false
+	}
+	for _, endpoint := range endpoints {
+		c.queueReprocess(agent.ServiceKey{Name: endpoint.Name, Namespace: endpoint.Namespace})
+	}
+	c.processPending()
+	return true
+}
+
+// reconcile processes the endpoints of all services with an external address, or with external addresses still published, in standalone mode.
+// The route table is fetched at most once for all services
+func (c *EndpointController) reconcile() {
+	services, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		log.Errorf("Failed to list services: %v", err)
+		return
+	}
+	serviceKeys := make(map[agent.ServiceKey]bool)
+	for _, service := range services {
+		if getExternalIPForService(service) != "" {
+			serviceKeys[agent.ServiceKey{Name: service.Name, Namespace: service.Namespace}] = true
+		}
+	}
+	KButler.RLock()
+	for serviceKey := range KButler.ServiceMap {
+		serviceKeys[serviceKey] = true
+	}
+	KButler.RUnlock()
+	var dev *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable
+	var devErr error
+	fetched := false
+	routeTable := func() (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error) {
+		if !fetched {
+			dev, devErr = fabric.RouteTable()
+			fetched = true
+		}
+		return dev, devErr
+	}
+	for serviceKey := range serviceKeys {
+		c.processService(serviceKey, routeTable)
+	}
+	metrics.ReconcileCompleted("endpointmgr")
+}
+
+// reprocess processes the endpoints of a service, forgetting the service once its endpoints are deleted
+func (c *EndpointController) reprocess(serviceKey agent.ServiceKey) {
+	c.processService(serviceKey, fabric.RouteTable)
+}
+
+// processService processes the endpoints of a service using routeTable to fetch the route table, forgetting the service once its endpoints are deleted
+func (c *EndpointController) processService(serviceKey agent.ServiceKey, routeTable func() (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error)) {
+	endpoint, err := c.endpointInformer.Lister().Endpoints(serviceKey.Namespace).Get(serviceKey.Name)
+	if errors.IsNotFound(err) {
+		forgetExternalAddresses(serviceKey)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to get endpoints of service: %s/%s: %v", serviceKey.Namespace, serviceKey.Name, err)
+		return
+	}
+	processEndpoint(endpoint, routeTable)
+}
+
+// forgetExternalAddresses stops publishing and tracking the external addresses of a service, once it is deleted or has none
+func forgetExternalAddresses(serviceKey agent.ServiceKey) {
+	releaseBFD(serviceKey, nil)
+	forgetPrefixes(serviceKey, "")
+	KButler.Lock()
+	defer KButler.Unlock()
+	if _, ok := KButler.ServiceMap[serviceKey]; ok {
+		processDeltas(nil, serviceKey)
+		delete(KButler.ServiceMap, serviceKey)
+	}
+}
+
+// forgetPrefixes stops tracking the routes to external addresses of a service, other than keep
+func forgetPrefixes(serviceKey agent.ServiceKey, keep string) {
+	externalPrefixesMu.Lock()
+	for prefix, owner := range externalPrefixes {
+		if owner == serviceKey && prefix != keep {
+			delete(externalPrefixes, prefix)
+		}
+	}
+	externalPrefixesMu.Unlock()
+	routeViewsMu.Lock()
+	for prefix, view := range routeViews {
+		if view.Namespace == serviceKey.Namespace && view.Service == serviceKey.Name && prefix != keep {
+			delete(routeViews, prefix)
+		}
+	}
+	routeViewsMu.Unlock()
+}
+
+// nodePortDown checks if all of the interfaces of this switch a node is attached to are down,
+// returning false if the node is not known to be attached to this switch
+func nodePortDown(nodeName string) bool {
+	interfaces := nodemgr.NodeInterfaces(nodeName)
+	if len(interfaces) == 0 {
+		return false
+	}
+	for _, interfaceName := range interfaces {
+		operState, err := fabric.InterfaceOperState(interfaceName)
+		if err != nil || operState == "up" {
+			return false
+		}
+	}
+	return true
+}
+
+// interfaceChanged reprocesses the endpoints of all services with an external address via a node attached to an interface that changed
+func (c *EndpointController) interfaceChanged(interfaceName string) {
+	// Subinterface notifications carry the name of their parent interface before the index
+	interfaceName = strings.SplitN(interfaceName, ".", 2)[0]
+	// The interfaces of nodes are read under the agent lock, so the hosts of each service are copied first
+	serviceHosts := make(map[agent.ServiceKey][]string)
+	KButler.RLock()
+	for serviceKey, endpointKeys := range KButler.ServiceMap {
+		for _, endpointKey := range endpointKeys {
+			serviceHosts[serviceKey] = append(serviceHosts[serviceKey], endpointKey.Hostname)
+		}
+	}
+	KButler.RUnlock()
+	var serviceKeys []agent.ServiceKey
+	for serviceKey, hostnames := range serviceHosts {
+		for _, hostname := range hostnames {
+			if fabric.ContainsAddress(nodemgr.NodeInterfaces(hostname), interfaceName) {
+				serviceKeys = append(serviceKeys, serviceKey)
+				break
+			}
+		}
+	}
+	c.queueReprocess(serviceKeys...)
+}
+
+// externalAddressMetricKey identifies an external address via a host in metrics
+func externalAddressMetricKey(serviceKey agent.ServiceKey, endpointKey agent.EndpointKey) string {
+	return fmt.Sprintf("%s/%s/%s/%s", serviceKey.Namespace, serviceKey.Name, endpointKey.ExternalAddress, endpointKey.Hostname)
+}
+
 // processDeltas takes a list of endpoints for a service, and compares it to the previous list stored, deleting any entries that no longer exist
 func processDeltas(newEndpoints []agent.EndpointKey, service agent.ServiceKey) {
 	// Iterate over the old endpoints, comparing to the new
@@ -84,133 +355,291 @@ func processDeltas(newEndpoints []agent.EndpointKey, service agent.ServiceKey) {
 		if !endpointMatched {
 			log.Infof("Unable to find match for old endpoint: %v, deleting", oldEndpoint)
 			KButler.DeleteEndpoint(service, oldEndpoint)
+			metrics.ExternalAddressState(externalAddressMetricKey(service, oldEndpoint), "", "")
 		}
 	}
 	KButler.ServiceMap[service] = newEndpoints
 }
 
-// processEndpoint processes adds/updates to Endpoints
-func processEndpoint(endpoint *v1.Endpoints) {
-	var serviceData config.Service
-	var externalRouteMatched bool
-	var externalRouteProgrammed bool
-	var nodeRouteMatched bool
-	var nodeRouteUnmatched bool
-	var externalAddress string
-	log.Infof("Processing endpoint... Endpoint name: %s, subsets: %v", endpoint.Name, endpoint.Subsets, endpoint.Subsets)
-	externalAddress = getExternalIPForService(endpoint.Name, endpoint.Namespace)
+// backendPods groups the addresses of an endpoint by the node hosting them, returning the pods on each node along with the nodes,
+// those hosting ready pods first, and whether each node hosts any ready pod
+func backendPods(endpoint *v1.Endpoints) (map[string][]config.BackendPod, []string, map[string]bool) {
+	nodePods := make(map[string][]config.BackendPod)
+	var nodes []string
+	readyNodes := make(map[string]bool)
+	addPod := func(address v1.EndpointAddress, ports []v1.EndpointPort, ready bool) {
+		// Check if nodename is a valid ptr
+		if address.NodeName == nil {
+			log.Infof("No valid nodename found for service: %s, address: %v", endpoint.Name, address.IP)
+			return
+		}
+		nodeName := *address.NodeName
+		var pod config.BackendPod
+		// Endpoints not backed by a pod are named after their address
+		pod.Name = address.IP
+		pod.Namespace = endpoint.Namespace
+		if address.TargetRef != nil {
+			pod.Name = address.TargetRef.Name
+			pod.Namespace = address.TargetRef.Namespace
+		}
+		pod.Address.Value = address.IP
+		pod.Ready.Value = ready
+		var podPorts []string
+		for _, port := range ports {
+			podPorts = append(podPorts, fmt.Sprintf("%s:%d/%s", port.Name, port.Port, port.Protocol))
+		}
+		pod.Ports.Value = strings.Join(podPorts, ",")
+		if _, ok := nodePods[nodeName]; !ok {
+			nodes = append(nodes, nodeName)
+		}
+		if ready {
+			readyNodes[nodeName] = true
+		}
+		nodePods[nodeName] = append(nodePods[nodeName], pod)
+	}
+	for _, endpointlist := range endpoint.Subsets {
+		for _, address := range endpointlist.Addresses {
+			addPod(address, endpointlist.Ports, true)
+		}
+	}
+	for _, endpointlist := range endpoint.Subsets {
+		for _, address := range endpointlist.NotReadyAddresses {
+			addPod(address, endpointlist.Ports, false)
+		}
+	}
+	return nodePods, nodes, readyNodes
+}
+
+// setReadinessGates marks pods declaring the route-programmed readiness gate as ready once the external address is programmed via their node
+func setReadinessGates(endpoint *v1.Endpoints, externalAddress string, nextHops []string) {
+	nodeAddresses := make(map[string]string)
+	setGate := func(address v1.EndpointAddress) {
+		if address.TargetRef == nil || address.TargetRef.Kind != "Pod" || address.NodeName == nil {
+			return
+		}
+		nodeAddress, ok := nodeAddresses[*address.NodeName]
+		if !ok {
+			nodeAddress = getIPFromNodeName(*address.NodeName)
+			nodeAddresses[*address.NodeName] = nodeAddress
+		}
+		if !fabric.ContainsAddress(nextHops, nodeAddress) {
+			return
+		}
+		pod, err := podLister.Pods(address.TargetRef.Namespace).Get(address.TargetRef.Name)
+		if err != nil {
+			return
+		}
+		message := fmt.Sprintf("Route to %s programmed via %s on %s", externalAddress, nodeAddress, KButler.Hostname)
+		if err := k8s.SetPodReadinessGate(Ctx, ClientSet, pod, k8s.RouteProgrammedCondition, message); err != nil {
+			log.Errorf("Failed to set readiness gate on pod: %s/%s: %v", address.TargetRef.Namespace, address.TargetRef.Name, err)
+		}
+	}
+	for _, endpointlist := range endpoint.Subsets {
+		for _, address := range endpointlist.Addresses {
+			setGate(address)
+		}
+		for _, address := range endpointlist.NotReadyAddresses {
+			setGate(address)
+		}
+	}
+}
+
+// nodeState is the state of an external address via a node backing a service
+type nodeState struct {
+	endpointKey agent.EndpointKey
+	data        config.Endpoint
+}
+
+// serviceOperState returns the state of a service and its reason from the route to its external address
+func serviceOperState(externalAddress string, routeMatched bool, routeProgrammed bool, nodeRouteUnmatched bool) (string, string) {
+	if !routeMatched {
+		return "down", "external-address-no-route"
+	}
+	if !routeProgrammed {
+		return "down", "external-address-not-programmed"
+	}
+	if nodeRouteUnmatched {
+		log.Infof("External address %s routable, but not all nodes are present, publishing oper-state degraded!", externalAddress)
+		return "degraded", "endpoint-nexthop-missing"
+	}
+	log.Infof("External address %s routable, and all nodes available, publishing oper-state up!", externalAddress)
+	return "up", ""
+}
+
+// bfdEnabled returns whether BFD is enabled towards nodes backing services.
+// BFD is configured on the switch and its sessions are learnt from NDK, so it is never enabled in standalone mode
+func bfdEnabled() bool {
+	return KButler.Config().BFD.Value && !KButler.Standalone
+}
+
+// processEndpoint processes adds/updates to Endpoints.
+// The state of the service is computed without holding the agent lock, which is only taken to publish it.
+// The route table is fetched with routeTable, only for services with an external address
+func processEndpoint(endpoint *v1.Endpoints, routeTable func() (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error)) {
+	// Nothing is published once kbutler is shutting down
+	if Ctx.Err() != nil {
+		return
+	}
+	log.Infof("Processing endpoint... Endpoint name: %s, subsets: %v", endpoint.Name, endpoint.Subsets)
+	service := getService(endpoint.Name, endpoint.Namespace)
+	externalAddress := getExternalIPForService(service)
 	serviceKey := agent.ServiceKey{Name: endpoint.Name, Namespace: endpoint.Namespace}
 	// We don't want to process services that do not have external addresses
-	if externalAddress != "" {
-		var currentEndpoints []agent.EndpointKey
-		for _, endpointlist := range endpoint.Subsets {
-			for _, address := range endpointlist.Addresses {
-				nodeName := address.NodeName
-				// Check if nodename is a valid ptr
-				if nodeName == nil {
-					log.Infof("No valid nodename found for service: %s, address: %v", endpoint.Name, address.IP)
-				} else {
-					var endpointData config.Endpoint
-					endpointKey := agent.EndpointKey{ExternalAddress: externalAddress, Hostname: *nodeName}
-					currentEndpoints = append(currentEndpoints, endpointKey)
-					log.Infof("Processing address: %v, node name: %s, for service: %s...", address.IP, *nodeName, endpoint.Name)
-					resp, err := gnmi.Get("/network-instance[name=default]/route-table")
-					if err != nil {
-						log.Infof("Received error while getting route table for endpoint: %s", endpoint.Name)
-						continue
-					}
-					dev := srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable{}
-					err = srlyangrelease.Unmarshal(resp.GetNotification()[0].GetUpdate()[0].GetVal().GetJsonIetfVal(), &dev)
-					if err != nil {
-						log.Infof("Received error while unmarshaling get response: %e", err)
-						continue
-					}
-					// log.Infof("Unmarshaled get response: %#v", dev)
-					// Ensure we have a valid route for the external address
-					nodeAddress := getIPFromNodeName(*nodeName)
-					for routekey, route := range dev.Ipv4Unicast.Route {
-						log.Infof("Iterating over route: %s, key: %s", *route.Ipv4Prefix, routekey)
-						// All routes will have a /32 prefix, and this is what is stored, so we need to match on that
-						routePrefix := fmt.Sprintf("%s/32", externalAddress)
-						// Check if the route matches
-						if *route.Ipv4Prefix == routePrefix {
-							externalRouteMatched = true
-							log.Infof("Got a match for external address: %s, prefix: %s, nexthops: %v", externalAddress, *route.Ipv4Prefix, *route.NextHopGroup)
-							// Check if the route is programmed
-							if route.FibProgramming.Status.String() == "success" {
-								externalRouteProgrammed = true
-								// Grab the next hops from the nexthopgroup
-								nextHopGroup := dev.NextHopGroup[*route.NextHopGroup]
-								for _, nextHop := range nextHopGroup.NextHop {
-									log.Infof("Found next hop for prefix: %s, via nexthopgroup: %s. Next hop: %s", routePrefix, *route.NextHopGroup, *nextHop.NextHop)
-									nextHopObj := dev.NextHop[*nextHop.NextHop]
-									log.Infof("Nexthop %s for prefix %s resolves to address: %s", *nextHop.NextHop, routePrefix, *nextHopObj.IpAddress)
-									if *nextHopObj.IpAddress == nodeAddress {
-										nodeRouteMatched = true
-									}
-								}
-								if nodeRouteMatched {
-									log.Infof("Node address %s is a valid next hop for external address %s, publishing oper-state up!", nodeAddress, routePrefix)
-									endpointData.HostAddress.Value = nodeAddress
-									endpointData.OperState.Value = "up"
-									endpointData.FIBProgrammed.Value = true
-								} else {
-									nodeRouteUnmatched = true
-									log.Infof("Node address %s is NOT a valid next hop for external address %s, publishing oper-state down!", nodeAddress, routePrefix)
-									endpointData.HostAddress.Value = nodeAddress
-									endpointData.OperState.Value = "down"
-									endpointData.OperReason.Value = "no-route-to-host"
-									endpointData.FIBProgrammed.Value = false
-								}
-								KButler.YangEndpoint[endpointKey] = &endpointData
-								KButler.UpdateEndpointTelemetry(serviceKey, endpointKey)
-							} else {
-								log.Infof("External route: %s is not programmed in the FIB", routePrefix)
-								externalRouteProgrammed = false
-							}
-						}
-					}
-				}
-			}
-			// Clean up removed endpoints
-			log.Infof("Cleaning up endpoint list, new endpoints: %v, old endpoints: %v", currentEndpoints, KButler.ServiceMap[serviceKey])
-			processDeltas(currentEndpoints, serviceKey)
-			// Process service updates
-			if externalRouteMatched {
-				// If we did, the service is either up or degraded
-				if externalRouteProgrammed {
-					if nodeRouteUnmatched {
-						log.Infof("External address %s routable, but not all nodes are present, publishing oper-state degraded!", externalAddress)
-						serviceData.OperState.Value = "degraded"
-						serviceData.OperReason.Value = "endpoint-nexthop-missing"
-					} else {
-						log.Infof("External address %s routable, and all nodes available, publishing oper-state up!", externalAddress)
-						serviceData.OperState.Value = "up"
-						serviceData.OperReason.Value = ""
-					}
-				} else {
-					serviceData.OperState.Value = "down"
-					serviceData.OperReason.Value = "external-address-not-programmed"
-				}
-			} else {
-				serviceData.OperState.Value = "down"
-				serviceData.OperReason.Value = "external-address-no-route"
-			}
-			KButler.YangService[serviceKey] = &serviceData
-			KButler.UpdateServiceTelemetry(serviceKey)
-		}
-	} else {
+	if externalAddress == "" {
 		log.Infof("Skipping processing for service: %s - no external IPs", endpoint.Name)
+		forgetExternalAddresses(serviceKey)
+		return
+	}
+	dev, err := routeTable()
+	if err != nil {
+		log.Infof("Received error while getting route table for endpoint: %s: %v", endpoint.Name, err)
+		return
+	}
+	// Ensure we have a valid route for the external address
+	routePrefix := fabric.HostPrefix(externalAddress)
+	forgetPrefixes(serviceKey, routePrefix)
+	externalPrefixesMu.Lock()
+	externalPrefixes[routePrefix] = serviceKey
+	externalPrefixesMu.Unlock()
+	externalRouteMatched, externalRouteProgrammed, nextHops := fabric.RouteNextHops(dev, routePrefix)
+	nodePods, nodes, readyNodes := backendPods(endpoint)
+
+	var currentEndpoints []agent.EndpointKey
+	var states []nodeState
+	var expectedNextHops, missingNextHops, bfdAddresses []string
+	var nodeRouteUnmatched bool
+	for _, nodeName := range nodes {
+		var endpointData config.Endpoint
+		endpointKey := agent.EndpointKey{ExternalAddress: externalAddress, Hostname: nodeName}
+		currentEndpoints = append(currentEndpoints, endpointKey)
+		endpointData.Pod = nodePods[nodeName]
+		log.Infof("Processing node name: %s, pods: %v, for service: %s...", nodeName, endpointData.Pod, endpoint.Name)
+		nodeAddress := getIPFromNodeName(nodeName)
+		ready := readyNodes[nodeName]
+		if ready {
+			expectedNextHops = append(expectedNextHops, nodeAddress)
+		}
+		if ready && bfdEnabled() {
+			configureBFD(serviceKey, nodeAddress)
+			bfdAddresses = append(bfdAddresses, nodeAddress)
+		}
+		if !externalRouteProgrammed {
+			continue
+		}
+		bfdState, bfdSession := "", false
+		if ready && bfdEnabled() {
+			bfdState, bfdSession = KButler.BFDSessionState(nodeAddress)
+		}
+		endpointData.HostAddress.Value = nodeAddress
+		endpointData.FIBProgrammed.Value = fabric.ContainsAddress(nextHops, nodeAddress)
+		if !ready {
+			// The node only hosts pods that are not ready, so it is not expected to be a next hop
+			log.Infof("Node %s only hosts pods that are not ready, publishing oper-state down for external address %s", nodeName, routePrefix)
+			endpointData.NotReady.Value = true
+			endpointData.OperState.Value = "down"
+			endpointData.OperReason.Value = "no-ready-pods"
+		} else if nodePortDown(nodeName) {
+			// The node is cabled to this switch, but none of its ports are up
+			nodeRouteUnmatched = true
+			missingNextHops = append(missingNextHops, nodeAddress)
+			log.Infof("All ports towards node %s are down, publishing oper-state down for external address %s!", nodeName, routePrefix)
+			endpointData.OperState.Value = "down"
+			endpointData.OperReason.Value = "node-port-down"
+		} else if bfdSession && bfdState != "up" {
+			// The node is unreachable, even if the route via it has not yet been withdrawn
+			nodeRouteUnmatched = true
+			missingNextHops = append(missingNextHops, nodeAddress)
+			log.Infof("BFD session to node address %s is %s, publishing oper-state down for external address %s!", nodeAddress, bfdState, routePrefix)
+			endpointData.OperState.Value = "down"
+			endpointData.OperReason.Value = "bfd-down"
+		} else if endpointData.FIBProgrammed.Value {
+			log.Infof("Node address %s is a valid next hop for external address %s, publishing oper-state up!", nodeAddress, routePrefix)
+			endpointData.OperState.Value = "up"
+		} else {
+			nodeRouteUnmatched = true
+			missingNextHops = append(missingNextHops, nodeAddress)
+			log.Infof("Node address %s is NOT a valid next hop for external address %s, publishing oper-state down!", nodeAddress, routePrefix)
+			endpointData.OperState.Value = "down"
+			endpointData.OperReason.Value = "no-route-to-host"
+		}
+		states = append(states, nodeState{endpointKey: endpointKey, data: endpointData})
+	}
+	// BFD is no longer needed towards nodes that stopped backing the service
+	releaseBFD(serviceKey, bfdAddresses)
+	operState, operReason := serviceOperState(externalAddress, externalRouteMatched, externalRouteProgrammed, nodeRouteUnmatched)
+
+	// Publish the state, keeping any spec already published for the service
+	KButler.Lock()
+	if Ctx.Err() != nil {
+		KButler.Unlock()
+		return
+	}
+	oldEndpointStates := make([]string, len(states))
+	for i := range states {
+		endpointKey := states[i].endpointKey
+		oldEndpointData := KButler.YangEndpoint[endpointKey]
+		if oldEndpointData != nil {
+			oldEndpointStates[i] = oldEndpointData.OperState.Value
+		}
+		KButler.YangEndpoint[endpointKey] = &states[i].data
+		KButler.UpdateEndpointTelemetry(serviceKey, endpointKey)
+		KButler.UpdateEndpointPodTelemetry(serviceKey, endpointKey, oldEndpointData)
+	}
+	// Clean up removed endpoints
+	log.Infof("Cleaning up endpoint list, new endpoints: %v, old endpoints: %v", currentEndpoints, KButler.ServiceMap[serviceKey])
+	processDeltas(currentEndpoints, serviceKey)
+	serviceData, ok := KButler.YangService[serviceKey]
+	if !ok {
+		serviceData = &config.Service{}
+		KButler.YangService[serviceKey] = serviceData
+	}
+	oldServiceState := serviceData.OperState.Value
+	serviceData.OperState.Value = operState
+	serviceData.OperReason.Value = operReason
+	KButler.UpdateServiceTelemetry(serviceKey)
+	KButler.Unlock()
+
+	for i, state := range states {
+		metrics.ExternalAddressState(externalAddressMetricKey(serviceKey, state.endpointKey), state.data.OperState.Value, state.data.OperReason.Value)
+		k8s.ExternalAddressStateEvent(KButler.Recorder, service, externalAddress, state.endpointKey.Hostname, oldEndpointStates[i], state.data.OperState.Value, state.data.OperReason.Value)
+	}
+	if externalRouteProgrammed {
+		setReadinessGates(endpoint, externalAddress, nextHops)
+	}
+	routeViewsMu.Lock()
+	routeViews[routePrefix] = RouteView{
+		Namespace:        endpoint.Namespace,
+		Service:          endpoint.Name,
+		ExternalAddress:  externalAddress,
+		Prefix:           routePrefix,
+		RouteMatched:     externalRouteMatched,
+		RouteProgrammed:  externalRouteProgrammed,
+		NextHops:         nextHops,
+		ExpectedNextHops: expectedNextHops,
+		MissingNextHops:  missingNextHops,
+		Updated:          time.Now(),
+	}
+	routeViewsMu.Unlock()
+	metrics.ServiceState(serviceKey.Namespace+"/"+serviceKey.Name, operState)
+	k8s.ServiceStateEvent(KButler.Recorder, service, oldServiceState, operState, operReason)
+	if KButler.Config().ServiceAnnotations.Value {
+		status := k8s.FabricStatus{State: operState, Reason: operReason, MissingNextHops: missingNextHops}
+		if err := k8s.PatchServiceFabricStatus(Ctx, ClientSet, service, KButler.Hostname, status); err != nil {
+			log.Errorf("Failed to annotate service: %s/%s with fabric status: %v", endpoint.Namespace, endpoint.Name, err)
+		}
 	}
 }
 
-// Run starts shared informers and waits for the shared informer cache to synchronize
-func (c *EndpointController) Run(stopCh chan struct{}) error {
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *EndpointController) Run(ctx context.Context) error {
 	// Starts all the shared informers that have been created by the factory so far
-	c.informerFactory.Start(stopCh)
+	c.informerFactory.Start(ctx.Done())
 	// wait for the initial synchronization of the local cache
-	if !cache.WaitForCacheSync(stopCh, c.endpointInformer.Informer().HasSynced) {
-		return fmt.Errorf("Failed to sync")
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.endpointInformer.Informer().HasSynced, c.podInformer.Informer().HasSynced, c.serviceInformer.Informer().HasSynced, c.nodeInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
 	}
 	return nil
 }
@@ -218,14 +647,9 @@ func (c *EndpointController) Run(stopCh chan struct{}) error {
 func (c *EndpointController) endpointAdd(obj interface{}) {
 	endpoint := obj.(*v1.Endpoints)
 	log.Infof("Endpoint CREATED: %s/%s", endpoint.Namespace, endpoint.Name)
+	metrics.InformerEvent("endpointmgr", "add")
 	// log.Infof("Endpoint %s/%s has ClusterIP: %v, ClusterIP/s: %v, ExternalIP/s: %v", endpoint.Namespace, endpoint.Name, endpoint.Spec.ClusterIP, endpoint.Spec.ClusterIPs, service.Spec.ExternalIPs)
-	processEndpoint(endpoint)
-	if endpoint.Namespace == "kube-system" {
-		if endpoint.Name == "srlinux-config" {
-			log.Infof("Endpoint has the correct name: %s", endpoint.Name)
-			processEndpoint(endpoint)
-		}
-	}
+	c.queueReprocess(agent.ServiceKey{Name: endpoint.Name, Namespace: endpoint.Namespace})
 }
 
 func (c *EndpointController) endpointUpdate(old, new interface{}) {
@@ -235,28 +659,54 @@ func (c *EndpointController) endpointUpdate(old, new interface{}) {
 		"Endpoint UPDATED. %s/%s %s",
 		oldEndpoint.Namespace, oldEndpoint.Name, newEndpoint.Name,
 	)
-	processEndpoint(newEndpoint)
-	if newEndpoint.Namespace == "kube-system" {
-		if newEndpoint.Name == "srlinux-config" {
-			log.Infof("Endpoint has the correct name: %s", newEndpoint.Name)
-			processEndpoint(newEndpoint)
-		}
+	metrics.InformerEvent("endpointmgr", "update")
+	c.queueReprocess(agent.ServiceKey{Name: newEndpoint.Name, Namespace: newEndpoint.Namespace})
+	// Resyncs redeliver all endpoints unchanged, each one recording that the informer went through all endpoints again
+	if oldEndpoint.ResourceVersion == newEndpoint.ResourceVersion {
+		metrics.ReconcileCompleted("endpointmgr")
 	}
 }
 
 func (c *EndpointController) endpointDelete(obj interface{}) {
 	endpoint := obj.(*v1.Endpoints)
 	log.Infof("Endpoint DELETED: %s/%s", endpoint.Namespace, endpoint.Name)
+	metrics.InformerEvent("endpointmgr", "delete")
+	c.queueReprocess(agent.ServiceKey{Name: endpoint.Name, Namespace: endpoint.Namespace})
 }
 
 // NewEndpointController creates a EndpointController
 func NewEndpointController(informerFactory informers.SharedInformerFactory) *EndpointController {
 	endpointInformer := informerFactory.Core().V1().Endpoints()
+	// Pods are only read from the cache, to check their readiness gates
+	podInformer := informerFactory.Core().V1().Pods()
+	serviceInformer := informerFactory.Core().V1().Services()
+	nodeInformer := informerFactory.Core().V1().Nodes()
 
 	c := &EndpointController{
 		informerFactory:  informerFactory,
 		endpointInformer: endpointInformer,
+		podInformer:      podInformer,
+		serviceInformer:  serviceInformer,
+		nodeInformer:     nodeInformer,
+		pending:          make(map[agent.ServiceKey]bool),
+		trigger:          make(chan struct{}, 1),
 	}
+	podLister = podInformer.Lister()
+	serviceLister = serviceInformer.Lister()
+	nodeLister = nodeInformer.Lister()
+	health.WatchInformer("endpointmgr/endpoints", endpointInformer.Informer())
+	health.WatchInformer("endpointmgr/pods", podInformer.Informer())
+	health.WatchInformer("endpointmgr/services", serviceInformer.Informer())
+	health.WatchInformer("endpointmgr/nodes", nodeInformer.Informer())
+	// The external address of a service is read from the cache, so services are reprocessed once it changes
+	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, new interface{}) {
+			oldService, newService := old.(*v1.Service), new.(*v1.Service)
+			if getExternalIPForService(oldService) != getExternalIPForService(newService) {
+				c.queueReprocess(agent.ServiceKey{Name: newService.Name, Namespace: newService.Namespace})
+			}
+		},
+	})
 	endpointInformer.Informer().AddEventHandler(
 		// Your custom resource event handlers.
 		cache.ResourceEventHandlerFuncs{
@@ -272,17 +722,60 @@ func NewEndpointController(informerFactory informers.SharedInformerFactory) *End
 }
 
 // EndpointMgr manages updates of Endpoints from K8
-func EndpointMgr(clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+func EndpointMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
 	KButler = kButler
 	ClientSet = clientSet
-	informerFactory := informers.NewSharedInformerFactory(clientSet, time.Hour*24)
+	Ctx = ctx
+	defer KButler.Wg.Done()
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
 	controller := NewEndpointController(informerFactory)
 
-	stop := make(chan struct{})
-	defer close(stop)
-	err := controller.Run(stop)
-	if err != nil {
-		log.Fatal(err)
+	if !KButler.SyncCaches(ctx, "endpointmgr", func() error { return controller.Run(ctx) }) {
+		return
+	}
+	KButler.CacheSync.Done()
+	if !KButler.Standalone {
+		// BFD kbutler created before a restart is only removed once all services are processed, as any of them may still need it
+		restoreBFD()
+		if controller.processAll() {
+			metrics.ReconcileCompleted("endpointmgr")
+			releaseUnownedBFD()
+		}
+	}
+	KButler.RegisterConfigHandler(func(cfg config.AgentConfig) {
+		if !cfg.BFD.Value {
+			go releaseAllBFD(Ctx)
+		}
+	})
+	// Handlers are called from the notification stream, so processing happens in the background
+	KButler.RegisterBFDSessionHandler(func(address string, state string) { go controller.bfdSessionChanged(address, state) })
+	KButler.RegisterRouteHandler(controller.routeChanged)
+	KButler.RegisterInterfaceHandler(func(notification *protos.InterfaceNotification) {
+		go controller.interfaceChanged(notification.GetKey().GetIfName())
+	})
+	// Changes on the switch are only noticed by processing all endpoints again in standalone mode.
+	// Endpoints listed on startup are queued by the informer, so the first full reconcile waits for the ticker
+	var reconcile <-chan time.Time
+	if KButler.Standalone {
+		ticker := time.NewTicker(standaloneReconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+	for {
+		select {
+		case <-controller.trigger:
+			controller.processPending()
+		case <-reconcile:
+			controller.reconcile()
+		case <-ctx.Done():
+			log.Infof("Stopping EndpointMgr...")
+			if !KButler.Standalone {
+				// The context of EndpointMgr is done, so the removal gets its own deadline within the shutdown timeout
+				releaseCtx, cancel := context.WithTimeout(context.Background(), bfdShutdownTimeout)
+				releaseAllBFD(releaseCtx)
+				cancel()
+			}
+			return
+		}
 	}
-	select {}
 }
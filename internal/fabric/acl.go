@@ -0,0 +1,232 @@
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ACLEntry is an entry of an IPv4 or IPv6 filter
+type ACLEntry struct {
+	SequenceID        uint32
+	Description       string
+	SourcePrefix      string
+	DestinationPrefix string
+	// Protocol is the IP protocol number, 0 matches any protocol
+	Protocol uint8
+	// DestinationPort is only matched when non-zero
+	DestinationPort uint16
+	Accept          bool
+}
+
+// Family returns the filter type an entry belongs to, based on its destination prefix
+func (e ACLEntry) Family() string {
+	if strings.Contains(e.DestinationPrefix, ":") || strings.Contains(e.SourcePrefix, ":") {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// aclEntryPath returns the path of an entry within a filter
+func aclEntryPath(family string, filterName string, sequenceID uint32) string {
+	return fmt.Sprintf("/acl/%s-filter[name=%s]/entry[sequence-id=%d]", family, filterName, sequenceID)
+}
+
+// Render returns the JSON representation of an entry, as used by the SR Linux ACL model
+func (e ACLEntry) Render() ([]byte, error) {
+	match := make(map[string]interface{})
+	if e.SourcePrefix != "" {
+		match["source-ip"] = map[string]string{"prefix": e.SourcePrefix}
+	}
+	if e.DestinationPrefix != "" {
+		match["destination-ip"] = map[string]string{"prefix": e.DestinationPrefix}
+	}
+	if e.Protocol != 0 {
+		if e.Family() == "ipv6" {
+			match["next-header"] = e.Protocol
+		} else {
+			match["protocol"] = e.Protocol
+		}
+	}
+	if e.DestinationPort != 0 {
+		match["destination-port"] = map[string]interface{}{"operator": "eq", "value": e.DestinationPort}
+	}
+	action := map[string]interface{}{"drop": map[string]interface{}{}}
+	if e.Accept {
+		action = map[string]interface{}{"accept": map[string]interface{}{}}
+	}
+	return json.Marshal(map[string]interface{}{
+		"sequence-id": e.SequenceID,
+		"description": e.Description,
+		"match":       match,
+		"action":      action,
+	})
+}
+
+// ACLBinding attaches the filter of a family to the input of a subinterface, named as interface.index
+type ACLBinding struct {
+	Subinterface string
+	Family       string
+}
+
+// path returns the path of the input filter of a family on a subinterface
+func (b ACLBinding) path() (string, error) {
+	separator := strings.LastIndex(b.Subinterface, ".")
+	if separator < 0 {
+		return "", fmt.Errorf("invalid subinterface %q, expected interface.index", b.Subinterface)
+	}
+	return fmt.Sprintf("/interface[name=%s]/subinterface[index=%s]/acl/input/%s-filter", b.Subinterface[:separator], b.Subinterface[separator+1:], b.Family), nil
+}
+
+// ACLChange is a change to the entries of a filter and the subinterfaces it is bound to
+type ACLChange struct {
+	FilterName string
+	Set        []ACLEntry
+	Delete     []ACLEntry
+	// Statistics lists the families of the filter to enable per-entry statistics on, creating the filter if needed
+	Statistics []string
+	Bind       []ACLBinding
+	Unbind     []ACLBinding
+}
+
+// Empty returns whether the change has nothing to apply
+func (c ACLChange) Empty() bool {
+	return len(c.Set) == 0 && len(c.Delete) == 0 && len(c.Statistics) == 0 && len(c.Bind) == 0 && len(c.Unbind) == 0
+}
+
+// ApplyACLChange applies a change to the switch as a single transaction, so traffic is never matched against a partial filter.
+// Binding a filter replaces any filter already bound to the subinterface for that family, callers check ACLBindings first
+func ApplyACLChange(ctx context.Context, change ACLChange) error {
+	var operations []setOperation
+	for _, entry := range change.Delete {
+		operations = append(operations, setOperation{path: aclEntryPath(entry.Family(), change.FilterName, entry.SequenceID)})
+	}
+	for _, binding := range change.Unbind {
+		path, err := binding.path()
+		if err != nil {
+			return err
+		}
+		operations = append(operations, setOperation{path: path})
+	}
+	for _, family := range change.Statistics {
+		operations = append(operations, setOperation{path: fmt.Sprintf("/acl/%s-filter[name=%s]/statistics-per-entry", family, change.FilterName), value: []byte("true")})
+	}
+	for _, entry := range change.Set {
+		jsonEntry, err := entry.Render()
+		if err != nil {
+			return err
+		}
+		operations = append(operations, setOperation{path: aclEntryPath(entry.Family(), change.FilterName, entry.SequenceID), value: jsonEntry, replace: true})
+	}
+	filterName, err := json.Marshal(change.FilterName)
+	if err != nil {
+		return err
+	}
+	for _, binding := range change.Bind {
+		path, err := binding.path()
+		if err != nil {
+			return err
+		}
+		operations = append(operations, setOperation{path: path, value: filterName})
+	}
+	if len(operations) == 0 {
+		return nil
+	}
+	return gnmiTransaction(ctx, "set", operations)
+}
+
+// ACLMatchedPackets returns the number of packets matched by each entry of a filter, keyed by sequence id
+func ACLMatchedPackets(family string, filterName string) (map[uint32]uint64, error) {
+	matched := make(map[uint32]uint64)
+	updates, err := get(fmt.Sprintf("/acl/%s-filter[name=%s]/entry[sequence-id=*]/statistics/matched-packets", family, filterName))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		sequenceID, err := strconv.ParseUint(u.Keys["sequence-id"], 10, 32)
+		if err != nil {
+			continue
+		}
+		// 64 bit counters are encoded as strings in JSON IETF
+		packets, err := strconv.ParseUint(strings.Trim(string(u.Value), "\""), 10, 64)
+		if err != nil {
+			continue
+		}
+		matched[uint32(sequenceID)] = packets
+	}
+	return matched, nil
+}
+
+// aclEntryState is the SR Linux ACL model of an entry, as returned by a gNMI get
+type aclEntryState struct {
+	Description string `json:"description"`
+	Match       struct {
+		SourceIP struct {
+			Prefix string `json:"prefix"`
+		} `json:"source-ip"`
+		DestinationIP struct {
+			Prefix string `json:"prefix"`
+		} `json:"destination-ip"`
+		// Protocols may also be returned by name, which is left unparsed
+		Protocol        json.RawMessage `json:"protocol"`
+		NextHeader      json.RawMessage `json:"next-header"`
+		DestinationPort struct {
+			Value uint16 `json:"value"`
+		} `json:"destination-port"`
+	} `json:"match"`
+	Action map[string]json.RawMessage `json:"action"`
+}
+
+// ACLEntries returns the entries of a filter configured on the switch.
+// The family of each entry is only preserved for entries matching on a prefix, as Family derives it from their prefixes
+func ACLEntries(family string, filterName string) ([]ACLEntry, error) {
+	var entries []ACLEntry
+	updates, err := get(fmt.Sprintf("/acl/%s-filter[name=%s]/entry[sequence-id=*]", family, filterName))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		sequenceID, err := strconv.ParseUint(u.Keys["sequence-id"], 10, 32)
+		if err != nil {
+			continue
+		}
+		var state aclEntryState
+		if err := json.Unmarshal(u.Value, &state); err != nil {
+			return nil, fmt.Errorf("unable to parse entry %d of %s filter %s: %v", sequenceID, family, filterName, err)
+		}
+		entry := ACLEntry{
+			SequenceID:        uint32(sequenceID),
+			Description:       state.Description,
+			SourcePrefix:      state.Match.SourceIP.Prefix,
+			DestinationPrefix: state.Match.DestinationIP.Prefix,
+			DestinationPort:   state.Match.DestinationPort.Value,
+		}
+		for _, protocol := range []json.RawMessage{state.Match.Protocol, state.Match.NextHeader} {
+			if number, err := strconv.ParseUint(string(protocol), 10, 8); err == nil {
+				entry.Protocol = uint8(number)
+			}
+		}
+		_, entry.Accept = state.Action["accept"]
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ACLBindings returns the filters of a family bound to the input of subinterfaces, keyed by binding
+func ACLBindings(family string) (map[ACLBinding]string, error) {
+	bindings := make(map[ACLBinding]string)
+	updates, err := get(fmt.Sprintf("/interface[name=*]/subinterface[index=*]/acl/input/%s-filter", family))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		var filterName string
+		if err := json.Unmarshal(u.Value, &filterName); err != nil {
+			continue
+		}
+		bindings[ACLBinding{Subinterface: fmt.Sprintf("%s.%s", u.Keys["name"], u.Keys["index"]), Family: family}] = filterName
+	}
+	return bindings, nil
+}
@@ -0,0 +1,41 @@
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// BFDTimers are the timers of BFD sessions on a subinterface
+type BFDTimers struct {
+	// MinTransmit and MinReceive are in microseconds
+	MinTransmit      uint32
+	MinReceive       uint32
+	DetectMultiplier uint32
+}
+
+// SetBFDSubinterface enables BFD on a subinterface with the specified timers.
+// Sessions are only created once a protocol, such as BGP, requests them towards a peer on the subinterface
+func SetBFDSubinterface(ctx context.Context, subinterface string, timers BFDTimers) error {
+	jsonConfig, err := json.Marshal(map[string]interface{}{
+		"admin-state":                       "enable",
+		"desired-minimum-transmit-interval": timers.MinTransmit,
+		"required-minimum-receive":          timers.MinReceive,
+		"detection-multiplier":              timers.DetectMultiplier,
+	})
+	if err != nil {
+		return err
+	}
+	return gnmiSet(ctx, fmt.Sprintf("/bfd/subinterface[id=%s]", subinterface), jsonConfig)
+}
+
+// DeleteBFDSubinterface removes the BFD configuration of a subinterface
+func DeleteBFDSubinterface(ctx context.Context, subinterface string) error {
+	return gnmiDelete(ctx, fmt.Sprintf("/bfd/subinterface[id=%s]", subinterface))
+}
+
+// BFDSubinterfaceConfigured checks if BFD is configured on a subinterface
+func BFDSubinterfaceConfigured(subinterface string) (bool, error) {
+	_, configured, err := getString(fmt.Sprintf("/bfd/subinterface[id=%s]/admin-state", subinterface))
+	return configured, err
+}
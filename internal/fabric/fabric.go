@@ -0,0 +1,268 @@
+package fabric
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "k8s.io/klog"
+
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// NetworkInstance is the network instance external addresses are routed in
+	NetworkInstance = "default"
+)
+
+// gnmiGet does a gNMI get on a path, recording its latency
+func gnmiGet(path string) (*gpb.GetResponse, error) {
+	start := time.Now()
+	resp, err := doGNMIGet(path)
+	if status.Code(err) == codes.NotFound {
+		metrics.ObserveGNMI("get", start, nil)
+	} else {
+		metrics.ObserveGNMI("get", start, err)
+	}
+	return resp, err
+}
+
+// gnmiSet does a gNMI set of a JSON value on a path, recording its latency
+func gnmiSet(ctx context.Context, path string, value []byte) error {
+	return gnmiTransaction(ctx, "set", []setOperation{{path: path, value: value}})
+}
+
+// gnmiDelete does a gNMI delete of a path, recording its latency
+func gnmiDelete(ctx context.Context, path string) error {
+	return gnmiTransaction(ctx, "delete", []setOperation{{path: path}})
+}
+
+// gnmiTransaction does a gNMI set of several operations in a single request, recording its latency
+func gnmiTransaction(ctx context.Context, operation string, operations []setOperation) error {
+	start := time.Now()
+	err := doGNMISet(ctx, operations)
+	metrics.ObserveGNMI(operation, start, err)
+	return err
+}
+
+// Reachable checks the gNMI server of the switch is answering requests
+func Reachable() error {
+	_, err := gnmiGet("/system/information/version")
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("gnmi get failed: %v", err)
+	}
+	return nil
+}
+
+// update is a single value returned by a gNMI get, along with the keys present in its path
+type update struct {
+	Keys  map[string]string
+	Value []byte
+}
+
+// get does a gNMI get on a path, returning each of the updates received
+func get(path string) ([]update, error) {
+	var updates []update
+	resp, err := gnmiGet(path)
+	// Paths that don't exist yield no updates rather than an error
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, notification := range resp.GetNotification() {
+		for _, u := range notification.GetUpdate() {
+			keys := make(map[string]string)
+			for _, elem := range notification.GetPrefix().GetElem() {
+				for name, value := range elem.GetKey() {
+					keys[name] = value
+				}
+			}
+			for _, elem := range u.GetPath().GetElem() {
+				for name, value := range elem.GetKey() {
+					keys[name] = value
+				}
+			}
+			updates = append(updates, update{Keys: keys, Value: u.GetVal().GetJsonIetfVal()})
+		}
+	}
+	return updates, nil
+}
+
+// getString does a gNMI get on a path to a leaf, returning its value and whether it exists
+func getString(path string) (string, bool, error) {
+	var value string
+	updates, err := get(path)
+	if err != nil {
+		return "", false, err
+	}
+	if len(updates) == 0 {
+		return "", false, nil
+	}
+	if err := json.Unmarshal(updates[0].Value, &value); err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// InterfaceOperState returns the operational state of an interface
+func InterfaceOperState(name string) (string, error) {
+	operState, _, err := getString(fmt.Sprintf("/interface[name=%s]/oper-state", name))
+	return operState, err
+}
+
+// Neighbor looks up the ARP or neighbor discovery entry for an address,
+// returning the interface and subinterface index it was learnt on, and whether an entry exists
+func Neighbor(address string) (string, string, bool, error) {
+	path := fmt.Sprintf("/interface[name=*]/subinterface[index=*]/ipv4/arp/neighbor[ipv4-address=%s]/link-layer-address", address)
+	if strings.Contains(address, ":") {
+		path = fmt.Sprintf("/interface[name=*]/subinterface[index=*]/ipv6/neighbor-discovery/neighbor[ipv6-address=%s]/link-layer-address", address)
+	}
+	updates, err := get(path)
+	if err != nil {
+		return "", "", false, err
+	}
+	for _, u := range updates {
+		if u.Keys["name"] != "" && u.Keys["name"] != "*" {
+			return u.Keys["name"], u.Keys["index"], true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// BGPSessionState returns the session state of the BGP neighbor with a peer address, and whether the neighbor is configured
+func BGPSessionState(peerAddress string) (string, bool, error) {
+	return getString(fmt.Sprintf("/network-instance[name=%s]/protocols/bgp/neighbor[peer-address=%s]/session-state", NetworkInstance, peerAddress))
+}
+
+// Hostname returns the host name of the switch
+func Hostname() (string, error) {
+	hostname, ok, err := getString("/system/name/host-name")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("switch has no host name")
+	}
+	return hostname, nil
+}
+
+// RouteTable retrieves the route table of the default network instance
+func RouteTable() (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error) {
+	return routeTable(gnmiGet)
+}
+
+// routeTable retrieves the route table of the default network instance using get
+func routeTable(get func(path string) (*gpb.GetResponse, error)) (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error) {
+	resp, err := get(fmt.Sprintf("/network-instance[name=%s]/route-table", NetworkInstance))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.GetNotification()) == 0 || len(resp.GetNotification()[0].GetUpdate()) == 0 {
+		return nil, fmt.Errorf("no route table in response")
+	}
+	dev := srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable{}
+	err = srlyangrelease.Unmarshal(resp.GetNotification()[0].GetUpdate()[0].GetVal().GetJsonIetfVal(), &dev)
+	if err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// RouteNextHops looks up a prefix in the route table, returning whether a route exists for it,
+// whether that route is programmed in the FIB, and the addresses of its next hops
+func RouteNextHops(dev *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, routePrefix string) (bool, bool, []string) {
+	var routeMatched bool
+	var routeProgrammed bool
+	var nextHops []string
+	var nextHopGroups []uint64
+	if dev.Ipv4Unicast != nil {
+		for routekey, route := range dev.Ipv4Unicast.Route {
+			log.Infof("Iterating over route: %s, key: %v", *route.Ipv4Prefix, routekey)
+			// Check if the route matches
+			if *route.Ipv4Prefix == routePrefix {
+				routeMatched = true
+				log.Infof("Got a match for prefix: %s, nexthop group: %d", *route.Ipv4Prefix, *route.NextHopGroup)
+				// Check if the route is programmed
+				if route.FibProgramming.Status.String() == "success" {
+					routeProgrammed = true
+					nextHopGroups = append(nextHopGroups, *route.NextHopGroup)
+				}
+			}
+		}
+	}
+	if dev.Ipv6Unicast != nil {
+		for routekey, route := range dev.Ipv6Unicast.Route {
+			log.Infof("Iterating over route: %s, key: %v", *route.Ipv6Prefix, routekey)
+			if *route.Ipv6Prefix == routePrefix {
+				routeMatched = true
+				log.Infof("Got a match for prefix: %s, nexthop group: %d", *route.Ipv6Prefix, *route.NextHopGroup)
+				if route.FibProgramming.Status.String() == "success" {
+					routeProgrammed = true
+					nextHopGroups = append(nextHopGroups, *route.NextHopGroup)
+				}
+			}
+		}
+	}
+	if routeMatched && !routeProgrammed {
+		log.Infof("Route: %s is not programmed in the FIB", routePrefix)
+	}
+	// Grab the next hops from the nexthopgroups
+	for _, nextHopGroupID := range nextHopGroups {
+		nextHopGroup, ok := dev.NextHopGroup[nextHopGroupID]
+		if !ok {
+			continue
+		}
+		for _, nextHop := range nextHopGroup.NextHop {
+			log.Infof("Found next hop for prefix: %s, via nexthopgroup: %d. Next hop: %d", routePrefix, nextHopGroupID, *nextHop.NextHop)
+			nextHopObj, ok := dev.NextHop[*nextHop.NextHop]
+			if !ok || nextHopObj.IpAddress == nil {
+				continue
+			}
+			log.Infof("Nexthop %d for prefix %s resolves to address: %s", *nextHop.NextHop, routePrefix, *nextHopObj.IpAddress)
+			nextHops = append(nextHops, *nextHopObj.IpAddress)
+		}
+	}
+	return routeMatched, routeProgrammed, nextHops
+}
+
+// HostPrefix returns the host route prefix for an address, /32 for IPv4 and /128 for IPv6
+func HostPrefix(address string) string {
+	if strings.Contains(address, ":") {
+		return fmt.Sprintf("%s/128", address)
+	}
+	return fmt.Sprintf("%s/32", address)
+}
+
+// ContainsAddress checks if an address is present in a list of addresses
+func ContainsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// LLDPManagementAddresses returns the management addresses advertised by an LLDP neighbor on an interface
+func LLDPManagementAddresses(interfaceName string, neighborID string) ([]string, error) {
+	var addresses []string
+	updates, err := get(fmt.Sprintf("/system/lldp/interface[name=%s]/neighbor[id=%s]/management-address[address=*]/address", interfaceName, neighborID))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range updates {
+		if address := u.Keys["address"]; address != "" && address != "*" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
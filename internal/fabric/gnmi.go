@@ -0,0 +1,321 @@
+package fabric
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/google/gnxi/utils/xpath"
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+	log "k8s.io/klog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultGNMITarget is the gNMI server of the switch kbutler runs on
+	DefaultGNMITarget = "unix:///opt/srlinux/var/run/sr_gnmi_server"
+	// gnmiTimeout bounds each gNMI get
+	gnmiTimeout = 30 * time.Second
+	// gnmiSetTimeout bounds a gNMI set, including its retries, and gnmiSetAttempts bounds the retries of a set failing with a transient error
+	gnmiSetTimeout  = 10 * time.Second
+	gnmiSetAttempts = 5
+)
+
+// GNMIConfig describes how to reach a gNMI server. TLS is used if any of TLSCA, TLSCert or SkipVerify is set
+type GNMIConfig struct {
+	// Target is a host:port or a unix:///path socket
+	Target     string
+	TLSCA      string
+	TLSCert    string
+	TLSKey     string
+	SkipVerify bool
+	Username   string
+	Password   string
+}
+
+// TLS returns whether the connection to the gNMI server is secured
+func (c GNMIConfig) TLS() bool {
+	return c.TLSCA != "" || c.TLSCert != "" || c.SkipVerify
+}
+
+// GNMIClient does the gNMI requests of the fabric package
+type GNMIClient interface {
+	Get(ctx context.Context, req *gpb.GetRequest) (*gpb.GetResponse, error)
+	Set(ctx context.Context, req *gpb.SetRequest) (*gpb.SetResponse, error)
+	// Target returns the address of the gNMI server, used to report the connection status
+	Target() string
+	Close() error
+}
+
+// GNMIStatus is the status of the connection to the gNMI server, as seen by the last request
+type GNMIStatus struct {
+	Target     string
+	Connected  bool
+	Reason     string
+	LastChange time.Time
+}
+
+// GNMIStatusHandler is called whenever the status of the connection to the gNMI server changes
+type GNMIStatusHandler func(GNMIStatus)
+
+var (
+	// gnmiMu guards the client used for gNMI requests and the status of its connection
+	gnmiMu       sync.Mutex
+	gnmiClient   GNMIClient
+	gnmiStatus   = GNMIStatus{Reason: "not connected"}
+	gnmiHandlers []GNMIStatusHandler
+)
+
+// passCred sends a username and password with each gNMI request
+type passCred struct {
+	username string
+	password string
+	secure   bool
+}
+
+func (pc passCred) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"username": pc.username, "password": pc.password}, nil
+}
+
+func (pc passCred) RequireTransportSecurity() bool {
+	return pc.secure
+}
+
+// grpcClient is a GNMIClient over a gRPC connection, dialled without waiting for the server
+type grpcClient struct {
+	gpb.GNMIClient
+	conn   *grpc.ClientConn
+	target string
+}
+
+// NewGNMIClient returns a client for the gNMI server described by cfg
+func NewGNMIClient(cfg GNMIConfig) (GNMIClient, error) {
+	opts := []grpc.DialOption{grpc.WithPerRPCCredentials(passCred{username: cfg.Username, password: cfg.Password, secure: cfg.TLS()})}
+	if cfg.TLS() {
+		tlsConfig, err := gnmiTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(cfg.Target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s failed: %v", cfg.Target, err)
+	}
+	return &grpcClient{GNMIClient: gpb.NewGNMIClient(conn), conn: conn, target: cfg.Target}, nil
+}
+
+// gnmiTLSConfig loads the CA and client certificate of cfg
+func gnmiTLSConfig(cfg GNMIConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.SkipVerify}
+	if cfg.TLSCA != "" {
+		ca, err := ioutil.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gNMI CA: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in gNMI CA %s", cfg.TLSCA)
+		}
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load gNMI client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (c *grpcClient) Get(ctx context.Context, req *gpb.GetRequest) (*gpb.GetResponse, error) {
+	return c.GNMIClient.Get(ctx, req, grpc.WaitForReady(true))
+}
+
+func (c *grpcClient) Set(ctx context.Context, req *gpb.SetRequest) (*gpb.SetResponse, error) {
+	return c.GNMIClient.Set(ctx, req, grpc.WaitForReady(true))
+}
+
+func (c *grpcClient) Target() string {
+	return c.target
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// SetGNMIClient sets the client gNMI requests are done with, closing the previous client
+func SetGNMIClient(client GNMIClient) {
+	gnmiMu.Lock()
+	previous := gnmiClient
+	gnmiClient = client
+	gnmiMu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	setGNMIStatus(false, "not connected")
+}
+
+// RegisterGNMIStatusHandler registers a handler to be called whenever the status of the connection to the gNMI server changes
+func RegisterGNMIStatusHandler(handler GNMIStatusHandler) {
+	gnmiMu.Lock()
+	defer gnmiMu.Unlock()
+	gnmiHandlers = append(gnmiHandlers, handler)
+}
+
+// CurrentGNMIStatus returns the status of the connection to the gNMI server
+func CurrentGNMIStatus() GNMIStatus {
+	gnmiMu.Lock()
+	defer gnmiMu.Unlock()
+	return gnmiStatus
+}
+
+// setGNMIStatus records the status of the connection to the gNMI server, notifying handlers if it changed
+func setGNMIStatus(connected bool, reason string) {
+	gnmiMu.Lock()
+	target := ""
+	if gnmiClient != nil {
+		target = gnmiClient.Target()
+	}
+	if gnmiStatus.Target == target && gnmiStatus.Connected == connected && gnmiStatus.Reason == reason {
+		gnmiMu.Unlock()
+		return
+	}
+	gnmiStatus = GNMIStatus{Target: target, Connected: connected, Reason: reason, LastChange: time.Now()}
+	current, handlers := gnmiStatus, append([]GNMIStatusHandler(nil), gnmiHandlers...)
+	gnmiMu.Unlock()
+	if connected {
+		log.Infof("Connected to gNMI server %s", target)
+	} else {
+		log.Errorf("Not connected to gNMI server %s: %s", target, reason)
+	}
+	for _, handler := range handlers {
+		handler(current)
+	}
+}
+
+// observeGNMIStatus updates the status of the connection from the result of a request.
+// Errors returned by the server about the request itself still mean it is reachable
+func observeGNMIStatus(err error) {
+	switch status.Code(err) {
+	case codes.OK, codes.NotFound, codes.InvalidArgument, codes.FailedPrecondition, codes.AlreadyExists, codes.Aborted:
+		setGNMIStatus(true, "")
+	default:
+		setGNMIStatus(false, err.Error())
+	}
+}
+
+// currentGNMIClient returns the client gNMI requests are done with
+func currentGNMIClient() (GNMIClient, error) {
+	gnmiMu.Lock()
+	defer gnmiMu.Unlock()
+	if gnmiClient == nil {
+		return nil, fmt.Errorf("no gNMI client configured")
+	}
+	return gnmiClient, nil
+}
+
+// pathError is returned for paths that can't be parsed, before any request is made
+type pathError struct {
+	path string
+	err  error
+}
+
+func (e *pathError) Error() string {
+	return fmt.Sprintf("error parsing xpath %q to gnmi path: %v", e.path, e.err)
+}
+
+// doGNMIGet does a gNMI get of a path, with values JSON IETF encoded
+func doGNMIGet(path string) (*gpb.GetResponse, error) {
+	client, err := currentGNMIClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gnmiGetVia(client, path)
+	if _, ok := err.(*pathError); !ok {
+		observeGNMIStatus(err)
+	}
+	return resp, err
+}
+
+// gnmiGetVia does a gNMI get of a path using client, with values JSON IETF encoded
+func gnmiGetVia(client GNMIClient, path string) (*gpb.GetResponse, error) {
+	gnmiPath, err := xpath.ToGNMIPath(path)
+	if err != nil {
+		return nil, &pathError{path: path, err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), gnmiTimeout)
+	defer cancel()
+	resp, err := client.Get(ctx, &gpb.GetRequest{Encoding: gpb.Encoding_JSON_IETF, Path: []*gpb.Path{gnmiPath}})
+	if err != nil {
+		log.Infof("gNMI get of %s failed for path %s: %v", client.Target(), path, err)
+	}
+	return resp, err
+}
+
+// setOperation updates a path with a JSON value, or deletes it if the value is nil.
+// With replace set, any existing content of the path not in the value is removed
+type setOperation struct {
+	path    string
+	value   []byte
+	replace bool
+}
+
+// doGNMISet does a gNMI set of operations in a single request, which the server applies as one transaction with deletes first, then replaces and updates.
+// Transient failures are retried straight away until ctx is done or gnmiSetTimeout has passed, requests waiting for the connection to be ready rather than sleeping
+func doGNMISet(ctx context.Context, operations []setOperation) error {
+	req := &gpb.SetRequest{}
+	for _, operation := range operations {
+		gnmiPath, err := xpath.ToGNMIPath(operation.path)
+		if err != nil {
+			return &pathError{path: operation.path, err: err}
+		}
+		if operation.value == nil {
+			req.Delete = append(req.Delete, gnmiPath)
+			continue
+		}
+		update := &gpb.Update{Path: gnmiPath, Val: &gpb.TypedValue{Value: &gpb.TypedValue_JsonIetfVal{JsonIetfVal: operation.value}}}
+		if operation.replace {
+			req.Replace = append(req.Replace, update)
+		} else {
+			req.Update = append(req.Update, update)
+		}
+	}
+	client, err := currentGNMIClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, gnmiSetTimeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		_, err = client.Set(ctx, req)
+		observeGNMIStatus(err)
+		if err == nil || !transientGNMIError(err) || attempt == gnmiSetAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Warningf("gNMI set of %d paths failed, first path %s (attempt: %d): %v", len(operations), operations[0].path, attempt, err)
+	}
+	if err != nil {
+		log.Errorf("gNMI set of %d paths failed, first path %s: %v", len(operations), operations[0].path, err)
+	}
+	return err
+}
+
+// transientGNMIError returns whether a request failed for reasons other than the request itself, so it may succeed if retried
+func transientGNMIError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
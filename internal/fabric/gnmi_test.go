@@ -0,0 +1,82 @@
+package fabric
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeGNMIClient answers each set with the next of its errors, repeating the last one
+type fakeGNMIClient struct {
+	errs []error
+	sets int
+}
+
+func (c *fakeGNMIClient) Get(ctx context.Context, req *gpb.GetRequest) (*gpb.GetResponse, error) {
+	return &gpb.GetResponse{}, nil
+}
+
+func (c *fakeGNMIClient) Set(ctx context.Context, req *gpb.SetRequest) (*gpb.SetResponse, error) {
+	err := c.errs[len(c.errs)-1]
+	if c.sets < len(c.errs) {
+		err = c.errs[c.sets]
+	}
+	c.sets++
+	if err == nil {
+		err = ctx.Err()
+	}
+	return &gpb.SetResponse{}, err
+}
+
+func (c *fakeGNMIClient) Target() string {
+	return "fake"
+}
+
+func (c *fakeGNMIClient) Close() error {
+	return nil
+}
+
+func TestDoGNMISet(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	invalid := status.Error(codes.InvalidArgument, "unknown element")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		errs     []error
+		wantSets int
+		wantCode codes.Code
+	}{
+		{name: "success", ctx: context.Background(), errs: []error{nil}, wantSets: 1, wantCode: codes.OK},
+		{name: "transient then success", ctx: context.Background(), errs: []error{unavailable, unavailable, nil}, wantSets: 3, wantCode: codes.OK},
+		{name: "transient until attempts run out", ctx: context.Background(), errs: []error{unavailable}, wantSets: gnmiSetAttempts, wantCode: codes.Unavailable},
+		{name: "request rejected", ctx: context.Background(), errs: []error{invalid}, wantSets: 1, wantCode: codes.InvalidArgument},
+		{name: "caller context done", ctx: cancelled, errs: []error{unavailable}, wantSets: 1, wantCode: codes.Unavailable},
+	}
+	defer SetGNMIClient(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeGNMIClient{errs: tt.errs}
+			SetGNMIClient(client)
+			start := time.Now()
+			err := doGNMISet(tt.ctx, []setOperation{{path: "/bfd/subinterface[id=ethernet-1/1.0]/admin-state", value: []byte(`"enable"`)}})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("doGNMISet() error = %v, want code %s", err, tt.wantCode)
+			}
+			if client.sets != tt.wantSets {
+				t.Errorf("doGNMISet() did %d sets, want %d", client.sets, tt.wantSets)
+			}
+			// Retries don't sleep, requests wait for the connection within the deadline instead
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("doGNMISet() took %s", elapsed)
+			}
+		})
+	}
+}
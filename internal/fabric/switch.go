@@ -0,0 +1,58 @@
+package fabric
+
+import (
+	"time"
+
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Switch roles within the fabric
+const (
+	RoleLeaf  = "leaf"
+	RoleSpine = "spine"
+)
+
+// Switch is a switch reached over its own gNMI client, for monitoring switches other than the one the
+// package functions are done against
+type Switch struct {
+	Name   string
+	Role   string
+	client GNMIClient
+}
+
+// NewSwitch returns a switch with a role in the fabric, reached using client
+func NewSwitch(name string, role string, client GNMIClient) *Switch {
+	return &Switch{Name: name, Role: role, client: client}
+}
+
+// Target returns the address of the gNMI server of the switch
+func (s *Switch) Target() string {
+	return s.client.Target()
+}
+
+// get does a gNMI get on a path of the switch, recording its latency
+func (s *Switch) get(path string) (*gpb.GetResponse, error) {
+	start := time.Now()
+	resp, err := gnmiGetVia(s.client, path)
+	if status.Code(err) == codes.NotFound {
+		metrics.ObserveGNMI("get", start, nil)
+	} else {
+		metrics.ObserveGNMI("get", start, err)
+	}
+	return resp, err
+}
+
+// RouteTable retrieves the route table of the default network instance of the switch
+func (s *Switch) RouteTable() (*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable, error) {
+	return routeTable(s.get)
+}
+
+// Close closes the connection to the switch
+func (s *Switch) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,395 @@
+package fleetmgr
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+
+	log "k8s.io/klog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// States of an external address, on a switch or across the fleet. Services without an external address are pending
+	StateUp       = "up"
+	StateDegraded = "degraded"
+	StateDown     = "down"
+	StateUnknown  = "unknown"
+	StatePending  = "pending"
+)
+
+var (
+	KButler   *agent.Agent
+	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+	// DynamicClient writes the ServiceReachability resources
+	DynamicClient dynamic.Interface
+
+	// Switches are the switches of the fleet, their route tables retrieved every Interval
+	Switches []*fabric.Switch
+	Interval time.Duration
+
+	// stateMu guards the state below, which is updated by the manager and read by the API
+	stateMu      sync.RWMutex
+	switchStatus = make(map[string]SwitchStatus)
+	reachability = make(map[agent.ServiceKey]ServiceReachability)
+)
+
+// SwitchStatus is whether the route table of a switch of the fleet could be retrieved
+type SwitchStatus struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Target    string    `json:"target"`
+	Reachable bool      `json:"reachable"`
+	Reason    string    `json:"reason,omitempty"`
+	LastPoll  time.Time `json:"lastPoll"`
+}
+
+// SwitchAddressState is the state of the route to an external address on a switch
+type SwitchAddressState struct {
+	Switch   string   `json:"switch"`
+	Role     string   `json:"role"`
+	State    string   `json:"state"`
+	Reason   string   `json:"reason,omitempty"`
+	NextHops []string `json:"nextHops,omitempty"`
+}
+
+// RoleCount is how many of the switches with a role reach an external address
+type RoleCount struct {
+	Role      string `json:"role"`
+	Reachable int    `json:"reachable"`
+	Total     int    `json:"total"`
+}
+
+// AddressReachability is the reachability of an external address across the fleet
+type AddressReachability struct {
+	Address  string               `json:"address"`
+	State    string               `json:"state"`
+	Summary  string               `json:"summary"`
+	Roles    []RoleCount          `json:"roles"`
+	Switches []SwitchAddressState `json:"switches"`
+}
+
+// ServiceReachability is the reachability of the external addresses of a service across the fleet,
+// written as the status of its ServiceReachability resource
+type ServiceReachability struct {
+	State     string                `json:"state"`
+	Summary   string                `json:"summary"`
+	Addresses []AddressReachability `json:"addresses"`
+}
+
+// FleetController struct
+type FleetController struct {
+	informerFactory informers.SharedInformerFactory
+	serviceInformer coreinformers.ServiceInformer
+	trigger         chan struct{}
+	// routeTables holds the route table last retrieved from each switch keyed by name, nil if it couldn't be retrieved
+	routeTables map[string]*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable
+}
+
+// poll retrieves the route table of each switch of the fleet in parallel
+func (c *FleetController) poll() {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, s := range Switches {
+		wg.Add(1)
+		go func(s *fabric.Switch) {
+			defer wg.Done()
+			table, err := s.RouteTable()
+			status := SwitchStatus{Name: s.Name, Role: s.Role, Target: s.Target(), Reachable: err == nil, LastPoll: time.Now()}
+			if err != nil {
+				log.Errorf("Failed to retrieve the route table of %s: %v", s.Name, err)
+				status.Reason = err.Error()
+			}
+			mu.Lock()
+			c.routeTables[s.Name] = table
+			mu.Unlock()
+			stateMu.Lock()
+			switchStatus[s.Name] = status
+			stateMu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// evaluateAddress computes the state of an external address on each switch, rolled up per role and across the fleet.
+// Switches whose route table couldn't be retrieved are left out of the roll-up, which is unknown if there are no others
+func (c *FleetController) evaluateAddress(address string) AddressReachability {
+	result := AddressReachability{Address: address}
+	counts := map[string]*RoleCount{fabric.RoleLeaf: {Role: fabric.RoleLeaf}, fabric.RoleSpine: {Role: fabric.RoleSpine}}
+	reachable, unknown := 0, 0
+	for _, s := range Switches {
+		state := SwitchAddressState{Switch: s.Name, Role: s.Role}
+		if table := c.routeTables[s.Name]; table == nil {
+			state.State = StateUnknown
+			state.Reason = "switch-unreachable"
+		} else {
+			present, programmed, nextHops := fabric.RouteNextHops(table, fabric.HostPrefix(address))
+			sort.Strings(nextHops)
+			state.NextHops = nextHops
+			if !present {
+				state.State = StateDown
+				state.Reason = "route-missing"
+			} else if !programmed {
+				state.State = StateDown
+				state.Reason = "route-not-programmed"
+			} else {
+				state.State = StateUp
+			}
+		}
+		result.Switches = append(result.Switches, state)
+		if state.State == StateUnknown {
+			unknown++
+			continue
+		}
+		counts[s.Role].Total++
+		if state.State == StateUp {
+			counts[s.Role].Reachable++
+			reachable++
+		}
+	}
+
+	var summary []string
+	for _, role := range []string{fabric.RoleLeaf, fabric.RoleSpine} {
+		count := counts[role]
+		if count.Total == 0 {
+			continue
+		}
+		result.Roles = append(result.Roles, *count)
+		summary = append(summary, fmt.Sprintf("%d/%d %ss", count.Reachable, count.Total, role))
+	}
+	if unknown > 0 {
+		summary = append(summary, fmt.Sprintf("%d/%d switches unknown", unknown, len(Switches)))
+	}
+	result.Summary = "reachable on " + strings.Join(summary, ", ")
+	switch known := len(Switches) - unknown; {
+	case known == 0:
+		result.State = StateUnknown
+		result.Summary = "unknown, no switch reachable"
+	case reachable == known:
+		result.State = StateUp
+	case reachable == 0:
+		result.State = StateDown
+	default:
+		result.State = StateDegraded
+	}
+	return result
+}
+
+// evaluateService computes the reachability of each external address of a service, the service taking the state of its worst address.
+// An address reached by some switches is worse than one whose state is unknown
+func (c *FleetController) evaluateService(service *v1.Service) ServiceReachability {
+	result := ServiceReachability{State: StatePending, Summary: "no external address"}
+	var summary []string
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP == "" {
+			continue
+		}
+		address := c.evaluateAddress(ingress.IP)
+		result.Addresses = append(result.Addresses, address)
+		summary = append(summary, fmt.Sprintf("%s %s", address.Address, address.Summary))
+	}
+	if len(result.Addresses) == 0 {
+		return result
+	}
+	sort.Slice(result.Addresses, func(i, j int) bool { return result.Addresses[i].Address < result.Addresses[j].Address })
+	sort.Strings(summary)
+	result.Summary = strings.Join(summary, "; ")
+	severity := map[string]int{StateUp: 0, StateUnknown: 1, StateDegraded: 2, StateDown: 3}
+	result.State = StateUp
+	for _, address := range result.Addresses {
+		if severity[address.State] > severity[result.State] {
+			result.State = address.State
+		}
+	}
+	return result
+}
+
+// reconcile evaluates every LoadBalancer service against the route tables last retrieved, writing the ServiceReachability of those that changed
+func (c *FleetController) reconcile() {
+	services, err := c.serviceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		log.Errorf("Failed to list services: %v", err)
+		return
+	}
+	desired := make(map[agent.ServiceKey]bool)
+	for _, service := range services {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		serviceKey := agent.ServiceKey{Name: service.Name, Namespace: service.Namespace}
+		desired[serviceKey] = true
+		result := c.evaluateService(service)
+
+		stateMu.RLock()
+		current, ok := reachability[serviceKey]
+		stateMu.RUnlock()
+		if ok && reflect.DeepEqual(current, result) {
+			continue
+		}
+		if Ctx.Err() != nil {
+			return
+		}
+		if err := k8s.ApplyServiceReachability(Ctx, DynamicClient, service, result); err != nil {
+			// Left unrecorded, so it is written again on the next reconcile
+			log.Errorf("Failed to write the reachability of service %s/%s: %v", service.Namespace, service.Name, err)
+			continue
+		}
+		log.Infof("Service %s/%s is %s across the fleet: %s", service.Namespace, service.Name, result.State, result.Summary)
+		stateMu.Lock()
+		reachability[serviceKey] = result
+		stateMu.Unlock()
+	}
+
+	stateMu.RLock()
+	var removed []agent.ServiceKey
+	for serviceKey := range reachability {
+		if !desired[serviceKey] {
+			removed = append(removed, serviceKey)
+		}
+	}
+	stateMu.RUnlock()
+	for _, serviceKey := range removed {
+		if err := k8s.DeleteServiceReachability(Ctx, DynamicClient, serviceKey.Namespace, serviceKey.Name); err != nil {
+			log.Errorf("Failed to delete the reachability of service %s/%s: %v", serviceKey.Namespace, serviceKey.Name, err)
+			continue
+		}
+		stateMu.Lock()
+		delete(reachability, serviceKey)
+		stateMu.Unlock()
+	}
+	metrics.ReconcileCompleted("fleetmgr")
+}
+
+// Reachability returns the reachability of each LoadBalancer service across the fleet
+func Reachability() map[agent.ServiceKey]ServiceReachability {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	result := make(map[agent.ServiceKey]ServiceReachability, len(reachability))
+	for serviceKey, r := range reachability {
+		result[serviceKey] = r
+	}
+	return result
+}
+
+// SwitchStatuses returns whether the route table of each switch of the fleet could last be retrieved, sorted by name
+func SwitchStatuses() []SwitchStatus {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	result := make([]SwitchStatus, 0, len(switchStatus))
+	for _, status := range switchStatus {
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// triggerReconcile requests a reconcile, coalescing requests made while one is pending
+func (c *FleetController) triggerReconcile(obj interface{}) {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *FleetController) Run(ctx context.Context) error {
+	// Starts all the shared informers that have been created by the factory so far
+	c.informerFactory.Start(ctx.Done())
+	// wait for the initial synchronization of the local cache
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.serviceInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
+	}
+	return nil
+}
+
+// NewFleetController creates a FleetController
+func NewFleetController(informerFactory informers.SharedInformerFactory) *FleetController {
+	serviceInformer := informerFactory.Core().V1().Services()
+
+	c := &FleetController{
+		informerFactory: informerFactory,
+		serviceInformer: serviceInformer,
+		trigger:         make(chan struct{}, 1),
+		routeTables:     make(map[string]*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable),
+	}
+	health.WatchInformer("fleetmgr/services", serviceInformer.Informer())
+	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.triggerReconcile,
+		UpdateFunc: func(old, new interface{}) { c.triggerReconcile(new) },
+		DeleteFunc: c.triggerReconcile,
+	})
+	return c
+}
+
+// Init sets the switches of the fleet, whose route tables are retrieved every interval, and creates the client
+// writing ServiceReachability resources
+func Init(kubeConfig *rest.Config, switches []*fabric.Switch, interval time.Duration) error {
+	client, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	DynamicClient = client
+	Switches = switches
+	Interval = interval
+	return nil
+}
+
+// FleetMgr evaluates each LoadBalancer service against the route tables of the switches of the fleet
+func FleetMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+	KButler = kButler
+	ClientSet = clientSet
+	Ctx = ctx
+	defer KButler.Wg.Done()
+	defer func() {
+		for _, s := range Switches {
+			s.Close()
+		}
+	}()
+
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
+	controller := NewFleetController(informerFactory)
+
+	if !KButler.SyncCaches(ctx, "fleetmgr", func() error { return controller.Run(ctx) }) {
+		return
+	}
+	KButler.CacheSync.Done()
+	// Route tables are only retrieved on the ticker, service changes are evaluated against the last retrieved
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	controller.poll()
+	for {
+		controller.reconcile()
+		select {
+		case <-controller.trigger:
+		case <-ticker.C:
+			controller.poll()
+		case <-ctx.Done():
+			log.Infof("Stopping FleetMgr...")
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package fleetmgr
+
+import (
+	"testing"
+
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+)
+
+const testAddress = "192.0.2.10"
+
+// routeTable returns a route table with a route to the test address in the FIB programming status, or without it if status is unset
+func routeTable(status srlyangrelease.E_SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming_Status) *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable {
+	table := &srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable{Ipv4Unicast: &srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast{}}
+	if status == srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming_Status_UNSET {
+		return table
+	}
+	route, _ := table.Ipv4Unicast.NewRoute(fabric.HostPrefix(testAddress), 0)
+	prefix, nextHopGroup := fabric.HostPrefix(testAddress), uint64(1)
+	route.Ipv4Prefix = &prefix
+	route.NextHopGroup = &nextHopGroup
+	route.FibProgramming = &srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming{Status: status}
+	return table
+}
+
+func TestEvaluateAddress(t *testing.T) {
+	var (
+		up          = routeTable(srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming_Status_success)
+		failed      = routeTable(srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming_Status_failed)
+		missing     = routeTable(srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable_Ipv4Unicast_Route_FibProgramming_Status_UNSET)
+		unreachable *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable
+	)
+	defer func() { Switches = nil }()
+	Switches = []*fabric.Switch{
+		fabric.NewSwitch("leaf1", fabric.RoleLeaf, nil),
+		fabric.NewSwitch("leaf2", fabric.RoleLeaf, nil),
+		fabric.NewSwitch("spine1", fabric.RoleSpine, nil),
+	}
+	type tables [3]*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable
+	tests := []struct {
+		name        string
+		tables      tables
+		wantState   string
+		wantSummary string
+		wantReasons [3]string
+	}{
+		{
+			name:        "reachable everywhere",
+			tables:      tables{up, up, up},
+			wantState:   StateUp,
+			wantSummary: "reachable on 2/2 leafs, 1/1 spines",
+		},
+		{
+			name:        "route missing on a leaf",
+			tables:      tables{up, missing, up},
+			wantState:   StateDegraded,
+			wantSummary: "reachable on 1/2 leafs, 1/1 spines",
+			wantReasons: [3]string{"", "route-missing", ""},
+		},
+		{
+			name:        "reachable nowhere",
+			tables:      tables{failed, missing, failed},
+			wantState:   StateDown,
+			wantSummary: "reachable on 0/2 leafs, 0/1 spines",
+			wantReasons: [3]string{"route-not-programmed", "route-missing", "route-not-programmed"},
+		},
+		{
+			name:        "unreachable switch left out",
+			tables:      tables{up, unreachable, up},
+			wantState:   StateUp,
+			wantSummary: "reachable on 1/1 leafs, 1/1 spines, 1/3 switches unknown",
+			wantReasons: [3]string{"", "switch-unreachable", ""},
+		},
+		{
+			name:        "unreachable switch and route missing",
+			tables:      tables{missing, unreachable, up},
+			wantState:   StateDegraded,
+			wantSummary: "reachable on 0/1 leafs, 1/1 spines, 1/3 switches unknown",
+			wantReasons: [3]string{"route-missing", "switch-unreachable", ""},
+		},
+		{
+			name:        "only unreachable switches",
+			tables:      tables{unreachable, unreachable, unreachable},
+			wantState:   StateUnknown,
+			wantSummary: "unknown, no switch reachable",
+			wantReasons: [3]string{"switch-unreachable", "switch-unreachable", "switch-unreachable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &FleetController{routeTables: make(map[string]*srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable)}
+			for i, s := range Switches {
+				c.routeTables[s.Name] = tt.tables[i]
+			}
+			got := c.evaluateAddress(testAddress)
+			if got.State != tt.wantState || got.Summary != tt.wantSummary {
+				t.Errorf("evaluateAddress() = %s %q, want %s %q", got.State, got.Summary, tt.wantState, tt.wantSummary)
+			}
+			for i, state := range got.Switches {
+				if state.Reason != tt.wantReasons[i] {
+					t.Errorf("switch %s has reason %q, want %q", state.Switch, state.Reason, tt.wantReasons[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/httpserver"
+
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog"
+)
+
+const (
+	// checkInterval is how often subsystems with a probe are checked
+	checkInterval = 10 * time.Second
+	// watchErrorWindow is how long after a watch error an informer is considered unhealthy
+	watchErrorWindow = time.Minute
+)
+
+// Probe checks the health of a subsystem, returning why it is unhealthy
+type Probe func() error
+
+// Handler is called whenever the health of a subsystem changes
+type Handler func()
+
+// Status is the health of a subsystem
+type Status struct {
+	Healthy    bool      `json:"healthy"`
+	Reason     string    `json:"reason,omitempty"`
+	LastChange time.Time `json:"last_change"`
+}
+
+var (
+	// mu guards the state below, which is updated by probes and subsystems reporting their own health
+	mu             sync.Mutex
+	subsystems     = make(map[string]*Status)
+	probes         = make(map[string]Probe)
+	handlers       []Handler
+	unhealthySince time.Time
+	exitTimeout    time.Duration
+
+	server = httpserver.New("health", handler())
+)
+
+// Register registers a subsystem, which is unhealthy until it is first reported on. If probe is not nil,
+// it is called periodically to determine the health of the subsystem
+func Register(name string, probe Probe) {
+	mu.Lock()
+	if _, ok := subsystems[name]; !ok {
+		subsystems[name] = &Status{Reason: "starting", LastChange: time.Now()}
+	}
+	if probe != nil {
+		probes[name] = probe
+	}
+	mu.Unlock()
+	notify()
+}
+
+// Set reports the health of a subsystem, a nil error being healthy
+func Set(name string, err error) {
+	status := Status{Healthy: err == nil, LastChange: time.Now()}
+	if err != nil {
+		status.Reason = err.Error()
+	}
+	mu.Lock()
+	current, ok := subsystems[name]
+	if ok && current.Healthy == status.Healthy && current.Reason == status.Reason {
+		mu.Unlock()
+		return
+	}
+	subsystems[name] = &status
+	mu.Unlock()
+	if status.Healthy {
+		log.Infof("Subsystem %s is healthy", name)
+	} else {
+		log.Errorf("Subsystem %s is unhealthy: %s", name, status.Reason)
+	}
+	notify()
+}
+
+// RegisterHandler registers a handler to be called whenever the health of a subsystem changes
+func RegisterHandler(handler Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers = append(handlers, handler)
+}
+
+func notify() {
+	mu.Lock()
+	current := append([]Handler(nil), handlers...)
+	mu.Unlock()
+	for _, handler := range current {
+		handler()
+	}
+}
+
+// Subsystems returns the health of each subsystem, keyed by name
+func Subsystems() map[string]Status {
+	mu.Lock()
+	defer mu.Unlock()
+	result := make(map[string]Status, len(subsystems))
+	for name, status := range subsystems {
+		result[name] = *status
+	}
+	return result
+}
+
+// Healthy returns whether all subsystems are healthy, along with the names of those that are not
+func Healthy() (bool, []string) {
+	var unhealthy []string
+	for name, status := range Subsystems() {
+		if !status.Healthy {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	sort.Strings(unhealthy)
+	return len(unhealthy) == 0, unhealthy
+}
+
+// SetExitTimeout sets how long the process may stay unhealthy before exiting, 0 never exits
+func SetExitTimeout(timeout time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	exitTimeout = timeout
+}
+
+// live returns false once the process has been unhealthy for longer than the exit timeout
+func live() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return exitTimeout == 0 || unhealthySince.IsZero() || time.Since(unhealthySince) < exitTimeout
+}
+
+// WatchInformer registers an informer as a subsystem, unhealthy until its cache has synced or while its watch is failing.
+// It must be called before the informer is started
+func WatchInformer(name string, informer cache.SharedIndexInformer) {
+	var watchMu sync.Mutex
+	var watchError error
+	var watchErrorTime time.Time
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+		watchMu.Lock()
+		watchError, watchErrorTime = err, time.Now()
+		watchMu.Unlock()
+	})
+	if err != nil {
+		log.Errorf("Unable to watch informer %s for errors: %v", name, err)
+	}
+	Register(name, func() error {
+		if !informer.HasSynced() {
+			return fmt.Errorf("cache not synced")
+		}
+		watchMu.Lock()
+		defer watchMu.Unlock()
+		if watchError != nil && time.Since(watchErrorTime) < watchErrorWindow {
+			return fmt.Errorf("watch failing: %v", watchError)
+		}
+		return nil
+	})
+}
+
+// check runs the probe of each subsystem, exiting if the process has been unhealthy for longer than the exit timeout
+func check() {
+	mu.Lock()
+	current := make(map[string]Probe, len(probes))
+	for name, probe := range probes {
+		current[name] = probe
+	}
+	mu.Unlock()
+	for name, probe := range current {
+		Set(name, probe())
+	}
+
+	healthy, unhealthy := Healthy()
+	mu.Lock()
+	defer mu.Unlock()
+	if healthy {
+		unhealthySince = time.Time{}
+		return
+	}
+	if unhealthySince.IsZero() {
+		unhealthySince = time.Now()
+	}
+	if exitTimeout != 0 && time.Since(unhealthySince) >= exitTimeout {
+		log.Exitf("Unhealthy for %s, exiting! Unhealthy subsystems: %v", time.Since(unhealthySince).Round(time.Second), unhealthy)
+	}
+}
+
+// Run periodically checks the health of subsystems with a probe until the context is cancelled
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		check()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handler serves /livez, failing once the process is about to exit as unhealthy, and /readyz, failing while any subsystem is unhealthy
+func handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, live())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		healthy, _ := Healthy()
+		writeStatus(w, healthy)
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(Subsystems()); err != nil {
+		log.Errorf("Failed to encode health response: %v", err)
+	}
+}
+
+// Listen serves health checks on address, replacing any server on a different address. An empty address stops serving
+func Listen(address string) {
+	server.Listen(address)
+}
@@ -0,0 +1,65 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	log "k8s.io/klog"
+)
+
+// Server is an HTTP server whose listen address can be changed at runtime
+type Server struct {
+	name    string
+	handler http.Handler
+
+	mu      sync.Mutex
+	server  *http.Server
+	address string
+}
+
+// New creates a Server serving handler, name is used in logs
+func New(name string, handler http.Handler) *Server {
+	return &Server{name: name, handler: handler}
+}
+
+// Listen serves on address, replacing any server on a different address. An empty address stops serving
+func (s *Server) Listen(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if address == s.address {
+		return
+	}
+	s.shutdown()
+	s.address = address
+	if address == "" {
+		return
+	}
+	server := &http.Server{Addr: address, Handler: s.handler}
+	s.server = server
+	go func() {
+		log.Infof("Serving %s on: %s", s.name, server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("%s server on: %s failed: %v", s.name, server.Addr, err)
+		}
+	}()
+}
+
+// Close stops serving
+func (s *Server) Close() {
+	s.Listen("")
+}
+
+// shutdown stops the current server, waiting a bounded time for requests in progress
+func (s *Server) shutdown() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to stop %s server on: %s: %v", s.name, s.address, err)
+	}
+	s.server = nil
+}
@@ -0,0 +1,418 @@
+package introspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/endpointmgr"
+	"github.com/brwallis/srlinux-kbutler/internal/fleetmgr"
+	"github.com/brwallis/srlinux-kbutler/internal/httpserver"
+
+	log "k8s.io/klog"
+)
+
+var (
+	KButler *agent.Agent
+
+	server = httpserver.New("api", handler())
+)
+
+// servicePort is a port exposed by a service, including its keys
+type servicePort struct {
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	config.ServicePort
+}
+
+// backendPod is a pod backing a service on a host, including its keys
+type backendPod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	config.BackendPod
+}
+
+// aclEntry is an ACL entry rendered for a service, including its key
+type aclEntry struct {
+	SequenceID uint32 `json:"sequence_id"`
+	config.ACLEntry
+}
+
+// ownedRoute is a route programmed for a service, including its key
+type ownedRoute struct {
+	Prefix string `json:"prefix"`
+	config.OwnedRoute
+}
+
+// serviceState is the state of a service as published under .kbutler.service
+type serviceState struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	config.Service
+	Ports       []servicePort     `json:"ports"`
+	Ingress     []string          `json:"ingress"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	ACLEntries  []aclEntry        `json:"acl_entries"`
+	Routes      []ownedRoute      `json:"routes"`
+}
+
+// endpointState is the state of an external address via a host as published under .kbutler.service.external_address
+type endpointState struct {
+	Namespace       string `json:"namespace"`
+	Service         string `json:"service"`
+	ExternalAddress string `json:"external_address"`
+	Hostname        string `json:"hostname"`
+	config.Endpoint
+	Pods []backendPod `json:"pods"`
+}
+
+// serviceMapEntry is the list of external address and host pairs tracked for a service
+type serviceMapEntry struct {
+	Namespace string              `json:"namespace"`
+	Service   string              `json:"service"`
+	Endpoints []agent.EndpointKey `json:"endpoints"`
+}
+
+// nextHops compares the next hops of the route to an external address with the nodes backing the service
+type nextHops struct {
+	Namespace       string   `json:"namespace"`
+	Service         string   `json:"service"`
+	ExternalAddress string   `json:"external_address"`
+	Expected        []string `json:"expected"`
+	Actual          []string `json:"actual"`
+	Missing         []string `json:"missing"`
+	Unexpected      []string `json:"unexpected"`
+}
+
+// explanation is why a service has its current oper-state
+type explanation struct {
+	Namespace  string   `json:"namespace"`
+	Service    string   `json:"service"`
+	OperState  string   `json:"oper_state"`
+	OperReason string   `json:"oper_reason"`
+	Details    []string `json:"details"`
+}
+
+// fleetService is the reachability of a service across the fleet, as written to its ServiceReachability resource
+type fleetService struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	fleetmgr.ServiceReachability
+}
+
+// filter selects state by namespace and service name, empty values match anything
+type filter struct {
+	namespace string
+	service   string
+}
+
+func newFilter(r *http.Request) filter {
+	return filter{namespace: r.URL.Query().Get("namespace"), service: r.URL.Query().Get("service")}
+}
+
+func (f filter) match(namespace string, service string) bool {
+	return (f.namespace == "" || f.namespace == namespace) && (f.service == "" || f.service == service)
+}
+
+// handler serves the API, all endpoints but /telemetry and /fleet/switches accept namespace and service query parameters
+func handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", serveServices)
+	mux.HandleFunc("/endpoints", serveEndpoints)
+	mux.HandleFunc("/servicemap", serveServiceMap)
+	mux.HandleFunc("/routes", serveRoutes)
+	mux.HandleFunc("/nexthops", serveNextHops)
+	mux.HandleFunc("/explain", serveExplain)
+	mux.HandleFunc("/telemetry", serveTelemetry)
+	mux.HandleFunc("/fleet", serveFleet)
+	mux.HandleFunc("/fleet/switches", serveFleetSwitches)
+	return mux
+}
+
+// Listen serves the API on address, replacing any server on a different address. An empty address stops serving
+func Listen(address string) {
+	server.Listen(address)
+}
+
+// API serves the API on the configured address, following configuration changes
+func API(kButler *agent.Agent) {
+	KButler = kButler
+	KButler.RegisterConfigHandler(func(cfg config.AgentConfig) {
+		Listen(cfg.APIAddress.Value)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		log.Errorf("Failed to encode API response: %v", err)
+	}
+}
+
+func serveServices(w http.ResponseWriter, r *http.Request) {
+	f := newFilter(r)
+	KButler.RLock()
+	services := []serviceState{}
+	for serviceKey, serviceData := range KButler.YangService {
+		if !f.match(serviceKey.Namespace, serviceKey.Name) {
+			continue
+		}
+		state := serviceState{
+			Namespace:   serviceKey.Namespace,
+			Name:        serviceKey.Name,
+			Service:     *serviceData,
+			Ingress:     serviceData.Ingress,
+			Labels:      serviceData.Label,
+			Annotations: serviceData.Annotation,
+		}
+		for _, port := range serviceData.Port {
+			state.Ports = append(state.Ports, servicePort{Port: port.Port, Protocol: port.Protocol, ServicePort: port})
+		}
+		for _, entry := range KButler.YangACL[serviceKey] {
+			state.ACLEntries = append(state.ACLEntries, aclEntry{SequenceID: entry.SequenceID, ACLEntry: entry})
+		}
+		for _, route := range KButler.YangRoute[serviceKey] {
+			state.Routes = append(state.Routes, ownedRoute{Prefix: route.Prefix, OwnedRoute: route})
+		}
+		services = append(services, state)
+	}
+	KButler.RUnlock()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Namespace+"/"+services[i].Name < services[j].Namespace+"/"+services[j].Name
+	})
+	writeJSON(w, services)
+}
+
+// endpoints returns the state of each external address via each host of services matching the filter, the agent must be read locked
+func endpoints(f filter) []endpointState {
+	endpoints := []endpointState{}
+	for serviceKey, endpointKeys := range KButler.ServiceMap {
+		if !f.match(serviceKey.Namespace, serviceKey.Name) {
+			continue
+		}
+		for _, endpointKey := range endpointKeys {
+			endpointData, ok := KButler.YangEndpoint[endpointKey]
+			if !ok {
+				continue
+			}
+			state := endpointState{
+				Namespace:       serviceKey.Namespace,
+				Service:         serviceKey.Name,
+				ExternalAddress: endpointKey.ExternalAddress,
+				Hostname:        endpointKey.Hostname,
+				Endpoint:        *endpointData,
+			}
+			for _, pod := range endpointData.Pod {
+				state.Pods = append(state.Pods, backendPod{Namespace: pod.Namespace, Name: pod.Name, BackendPod: pod})
+			}
+			endpoints = append(endpoints, state)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return fmt.Sprint(endpoints[i].Namespace, endpoints[i].Service, endpoints[i].ExternalAddress, endpoints[i].Hostname) <
+			fmt.Sprint(endpoints[j].Namespace, endpoints[j].Service, endpoints[j].ExternalAddress, endpoints[j].Hostname)
+	})
+	return endpoints
+}
+
+func serveEndpoints(w http.ResponseWriter, r *http.Request) {
+	KButler.RLock()
+	endpoints := endpoints(newFilter(r))
+	KButler.RUnlock()
+	writeJSON(w, endpoints)
+}
+
+func serveServiceMap(w http.ResponseWriter, r *http.Request) {
+	f := newFilter(r)
+	KButler.RLock()
+	serviceMap := []serviceMapEntry{}
+	for serviceKey, endpointKeys := range KButler.ServiceMap {
+		if !f.match(serviceKey.Namespace, serviceKey.Name) {
+			continue
+		}
+		serviceMap = append(serviceMap, serviceMapEntry{
+			Namespace: serviceKey.Namespace,
+			Service:   serviceKey.Name,
+			Endpoints: append([]agent.EndpointKey(nil), endpointKeys...),
+		})
+	}
+	KButler.RUnlock()
+	sort.Slice(serviceMap, func(i, j int) bool {
+		return serviceMap[i].Namespace+"/"+serviceMap[i].Service < serviceMap[j].Namespace+"/"+serviceMap[j].Service
+	})
+	writeJSON(w, serviceMap)
+}
+
+// routeViews returns the route to each external address of services matching the filter, sorted by prefix
+func routeViews(f filter) []endpointmgr.RouteView {
+	views := []endpointmgr.RouteView{}
+	for _, view := range endpointmgr.RouteViews() {
+		if f.match(view.Namespace, view.Service) {
+			views = append(views, view)
+		}
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Prefix < views[j].Prefix
+	})
+	return views
+}
+
+func serveRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, routeViews(newFilter(r)))
+}
+
+// difference returns the addresses in a that are not in b
+func difference(a []string, b []string) []string {
+	present := make(map[string]bool, len(b))
+	for _, address := range b {
+		present[address] = true
+	}
+	result := []string{}
+	for _, address := range a {
+		if !present[address] {
+			result = append(result, address)
+		}
+	}
+	return result
+}
+
+func serveNextHops(w http.ResponseWriter, r *http.Request) {
+	result := []nextHops{}
+	for _, view := range routeViews(newFilter(r)) {
+		result = append(result, nextHops{
+			Namespace:       view.Namespace,
+			Service:         view.Service,
+			ExternalAddress: view.ExternalAddress,
+			Expected:        view.ExpectedNextHops,
+			Actual:          view.NextHops,
+			Missing:         difference(view.ExpectedNextHops, view.NextHops),
+			Unexpected:      difference(view.NextHops, view.ExpectedNextHops),
+		})
+	}
+	writeJSON(w, result)
+}
+
+// explain describes why a service has its current oper-state, from its published state and the route to its external address
+func explain(serviceKey agent.ServiceKey) (explanation, bool) {
+	result := explanation{Namespace: serviceKey.Namespace, Service: serviceKey.Name}
+	f := filter{namespace: serviceKey.Namespace, service: serviceKey.Name}
+	KButler.RLock()
+	serviceData, ok := KButler.YangService[serviceKey]
+	if ok {
+		result.OperState = serviceData.OperState.Value
+		result.OperReason = serviceData.OperReason.Value
+	}
+	endpoints := endpoints(f)
+	KButler.RUnlock()
+	if !ok {
+		return result, false
+	}
+
+	details := []string{}
+	switch result.OperReason {
+	case "no-external-address-assigned":
+		details = append(details, "The service has not been assigned an external address by its load balancer")
+	case "processing-service-update":
+		details = append(details, "The service has changed and its endpoints have not been processed since")
+	}
+	for _, view := range routeViews(f) {
+		switch {
+		case !view.RouteMatched:
+			details = append(details, fmt.Sprintf("There is no route to external address %s (%s) in the route table", view.ExternalAddress, view.Prefix))
+		case !view.RouteProgrammed:
+			details = append(details, fmt.Sprintf("The route to external address %s (%s) is present but not programmed in hardware", view.ExternalAddress, view.Prefix))
+		default:
+			details = append(details, fmt.Sprintf("The route to external address %s (%s) is programmed via %s", view.ExternalAddress, view.Prefix, strings.Join(view.NextHops, ", ")))
+		}
+		if len(view.ExpectedNextHops) == 0 {
+			details = append(details, fmt.Sprintf("No ready pods back external address %s", view.ExternalAddress))
+		}
+		if missing := difference(view.ExpectedNextHops, view.NextHops); len(missing) > 0 {
+			details = append(details, fmt.Sprintf("Nodes backing the service missing as next hops: %s", strings.Join(missing, ", ")))
+		}
+		if unexpected := difference(view.NextHops, view.ExpectedNextHops); len(unexpected) > 0 {
+			details = append(details, fmt.Sprintf("Next hops not backing the service: %s", strings.Join(unexpected, ", ")))
+		}
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.OperState.Value == "up" {
+			continue
+		}
+		details = append(details, fmt.Sprintf("External address %s via host %s (%s) is %s: %s", endpoint.ExternalAddress, endpoint.Hostname, endpoint.HostAddress.Value, endpoint.OperState.Value, endpointReason(endpoint.OperReason.Value)))
+	}
+	if result.OperState == "up" {
+		details = append(details, "All nodes backing the service are next hops of the route to its external address")
+	}
+	result.Details = details
+	return result, true
+}
+
+// endpointReason describes the reason an external address is down via a host
+func endpointReason(reason string) string {
+	switch reason {
+	case "node-port-down":
+		return "all ports of this device towards the node are down"
+	case "bfd-down":
+		return "the BFD session to the node is not up"
+	case "no-route-to-host":
+		return "the node is not a next hop of the route to the external address"
+	case "no-ready-pods":
+		return "the node only hosts pods that are not ready"
+	}
+	return reason
+}
+
+func serveExplain(w http.ResponseWriter, r *http.Request) {
+	f := newFilter(r)
+	if f.namespace == "" || f.service == "" {
+		http.Error(w, "namespace and service query parameters are required", http.StatusBadRequest)
+		return
+	}
+	result, ok := explain(agent.ServiceKey{Namespace: f.namespace, Name: f.service})
+	if !ok {
+		http.Error(w, fmt.Sprintf("service %s/%s is not known to kbutler", f.namespace, f.service), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// serveTelemetry serves the state published by kbutler keyed by path, which is all of it in standalone mode.
+// The path query parameter selects a path along with everything below it, a list path without keys selecting all of its entries
+func serveTelemetry(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("path")
+	telemetry := KButler.Telemetry()
+	for path := range telemetry {
+		if prefix != "" && path != prefix && !strings.HasPrefix(path, prefix+".") && !strings.HasPrefix(path, prefix+"{") {
+			delete(telemetry, path)
+		}
+	}
+	writeJSON(w, telemetry)
+}
+
+// serveFleet serves the reachability of each LoadBalancer service across the fleet, empty unless running in fleet mode
+func serveFleet(w http.ResponseWriter, r *http.Request) {
+	f := newFilter(r)
+	services := []fleetService{}
+	for serviceKey, reachability := range fleetmgr.Reachability() {
+		if !f.match(serviceKey.Namespace, serviceKey.Name) {
+			continue
+		}
+		services = append(services, fleetService{Namespace: serviceKey.Namespace, Service: serviceKey.Name, ServiceReachability: reachability})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Namespace+"/"+services[i].Service < services[j].Namespace+"/"+services[j].Service
+	})
+	writeJSON(w, services)
+}
+
+// serveFleetSwitches serves whether the route table of each switch of the fleet could last be retrieved
+func serveFleetSwitches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, fleetmgr.SwitchStatuses())
+}
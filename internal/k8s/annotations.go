@@ -0,0 +1,65 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// FabricAnnotationPrefix prefixes all annotations kbutler writes to Kubernetes objects
+	FabricAnnotationPrefix = "fabric.srlinux.io/"
+)
+
+// FabricStatus is the state of a service as seen by a single switch
+type FabricStatus struct {
+	State           string
+	Reason          string
+	MissingNextHops []string
+}
+
+// optionalValue returns nil for empty values, removing the annotation when patched
+func optionalValue(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// PatchServiceFabricStatus records the status of a service as seen by switchName in annotations on the service,
+// only patching the service if the status has changed
+func PatchServiceFabricStatus(ctx context.Context, clientSet *kubernetes.Clientset, service *v1.Service, switchName string, status FabricStatus) error {
+	statusKey := FabricAnnotationPrefix + switchName
+	annotations := map[string]*string{
+		statusKey:                        optionalValue(status.State),
+		statusKey + ".reason":            optionalValue(status.Reason),
+		statusKey + ".missing-next-hops": optionalValue(strings.Join(status.MissingNextHops, ",")),
+	}
+
+	changed := false
+	for key, value := range annotations {
+		current, ok := service.Annotations[key]
+		if (value == nil && ok) || (value != nil && (!ok || current != *value)) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Services(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,64 @@
+package k8s
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "kbutler"
+	// Each service may burst this many events, refilling at eventQPS
+	eventBurst = 10
+	eventQPS   = 1.0 / 60
+)
+
+// NewEventRecorder returns a rate limited recorder emitting events from kbutler running on host
+func NewEventRecorder(clientSet *kubernetes.Clientset, host string) record.EventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       eventQPS,
+	})
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent, Host: host})
+}
+
+// eventType returns the type of event to emit for an oper-state
+func eventType(state string) string {
+	if state == "up" || state == "pending" {
+		return v1.EventTypeNormal
+	}
+	return v1.EventTypeWarning
+}
+
+// stateMessage formats an oper-state change for an event message
+func stateMessage(oldState string, state string, reason string) string {
+	if oldState == "" {
+		oldState = "unknown"
+	}
+	if reason == "" {
+		return fmt.Sprintf("changed from %s to %s", oldState, state)
+	}
+	return fmt.Sprintf("changed from %s to %s (%s)", oldState, state, reason)
+}
+
+// ServiceStateEvent emits an event against a service when its fabric oper-state changes
+func ServiceStateEvent(recorder record.EventRecorder, service *v1.Service, oldState string, state string, reason string) {
+	// Transient states aren't worth an event
+	if recorder == nil || service == nil || oldState == state || state == "updating" {
+		return
+	}
+	recorder.Eventf(service, eventType(state), "FabricStateChanged", "Fabric oper-state %s", stateMessage(oldState, state, reason))
+}
+
+// ExternalAddressStateEvent emits an event against a service when the fabric oper-state of one of its external addresses changes
+func ExternalAddressStateEvent(recorder record.EventRecorder, service *v1.Service, address string, hostname string, oldState string, state string, reason string) {
+	if recorder == nil || service == nil || oldState == state {
+		return
+	}
+	recorder.Eventf(service, eventType(state), "ExternalAddressStateChanged", "Fabric oper-state of external address %s via %s %s", address, hostname, stateMessage(oldState, state, reason))
+}
@@ -24,31 +24,29 @@ func K8Init() *kubernetes.Clientset {
 	return ClientSet
 }
 
-// Client initializes the interface towards the K8 API server
-func Client(kubeConfig string) (*kubernetes.Clientset, *rest.Config) {
+// Client initializes the interface towards the K8 API server, using the in-cluster configuration if available
+// and the kubeconfig file otherwise, and checks the API server can be reached
+func Client(kubeConfig string) (*kubernetes.Clientset, *rest.Config, error) {
 	var config *rest.Config
-	var clientSet *kubernetes.Clientset
 	var err error
 	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != "" {
 		config, err = rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
-		}
-		clientSet, err = kubernetes.NewForConfig(config)
-		if err != nil {
-			panic(err.Error())
-		}
-	} else {
+	} else if kubeConfig != "" {
 		config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-		if err != nil {
-			panic(err.Error())
-		}
-		clientSet, err = kubernetes.NewForConfig(config)
-		if err != nil {
-			panic(err.Error())
-		}
+	} else {
+		return nil, nil, fmt.Errorf("not running in a cluster and no kubeconfig set")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := clientSet.Discovery().ServerVersion(); err != nil {
+		return nil, nil, fmt.Errorf("unable to reach API server %s: %v", config.Host, err)
 	}
-	return clientSet, config
+	return clientSet, config, nil
 }
 
 // countPods takes a K8 clientSet and a node name and returns a count of pods matching
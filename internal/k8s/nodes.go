@@ -0,0 +1,138 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// FabricReachableCondition prefixes the conditions reporting whether each switch of the fabric can reach a node
+	FabricReachableCondition v1.NodeConditionType = "FabricReachable"
+)
+
+// FabricReachableConditionType returns the condition reporting whether switchName can reach a node,
+// so that each switch a node is attached to maintains its own condition
+func FabricReachableConditionType(switchName string) v1.NodeConditionType {
+	return FabricReachableCondition + v1.NodeConditionType("-"+LabelValue(switchName))
+}
+
+// SetNodeCondition sets a condition on a node, only patching the node if the status, reason or message of the condition has changed
+func SetNodeCondition(ctx context.Context, clientSet *kubernetes.Clientset, node *v1.Node, conditionType v1.NodeConditionType, status v1.ConditionStatus, reason string, message string) error {
+	now := metav1.Now()
+	condition := v1.NodeCondition{
+		Type:               conditionType,
+		Status:             status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+	for _, current := range node.Status.Conditions {
+		if current.Type != conditionType {
+			continue
+		}
+		if current.Status == status && current.Reason == reason && current.Message == message {
+			return nil
+		}
+		if current.Status == status {
+			condition.LastTransitionTime = current.LastTransitionTime
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+const (
+	// SwitchLabel, PortLabel and RackLabel record the fabric placement of a node
+	SwitchLabel = FabricAnnotationPrefix + "switch"
+	PortLabel   = FabricAnnotationPrefix + "port"
+	RackLabel   = FabricAnnotationPrefix + "rack"
+	// PortsAnnotation lists all interfaces a node is attached to, unmodified as label values can't contain them
+	PortsAnnotation = FabricAnnotationPrefix + "ports"
+)
+
+// FabricPlacement is the switch and ports a node is attached to, an empty placement removes it from the node
+type FabricPlacement struct {
+	Switch string
+	Ports  []string
+	Rack   string
+}
+
+// invalidLabelCharacters matches the characters not allowed in label values
+var invalidLabelCharacters = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// isAlphanumeric checks if a character may start or end a label value
+func isAlphanumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// LabelValue converts a value to a valid label value: at most 63 characters, starting and ending with an alphanumeric character
+func LabelValue(value string) string {
+	value = invalidLabelCharacters.ReplaceAllString(value, "_")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.TrimFunc(value, func(r rune) bool { return !isAlphanumeric(r) })
+}
+
+// PatchNodeFabricPlacement records the fabric placement of a node in labels and annotations on the node,
+// only patching the node if the placement has changed
+func PatchNodeFabricPlacement(ctx context.Context, clientSet *kubernetes.Clientset, node *v1.Node, placement FabricPlacement) error {
+	var port string
+	if len(placement.Ports) > 0 {
+		port = LabelValue(placement.Ports[0])
+	}
+	labels := map[string]*string{
+		SwitchLabel: optionalValue(LabelValue(placement.Switch)),
+		PortLabel:   optionalValue(port),
+		RackLabel:   optionalValue(LabelValue(placement.Rack)),
+	}
+	annotations := map[string]*string{
+		PortsAnnotation: optionalValue(strings.Join(placement.Ports, ",")),
+	}
+
+	changed := false
+	for key, value := range labels {
+		current, ok := node.Labels[key]
+		if (value == nil && ok) || (value != nil && (!ok || current != *value)) {
+			changed = true
+		}
+	}
+	for key, value := range annotations {
+		current, ok := node.Annotations[key]
+		if (value == nil && ok) || (value != nil && (!ok || current != *value)) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,30 @@
+package k8s
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "valid", value: "leaf1", want: "leaf1"},
+		{name: "interface", value: "ethernet-1/1", want: "ethernet-1_1"},
+		{name: "colons and spaces", value: "mgmt0 2001:db8::1", want: "mgmt0_2001_db8__1"},
+		{name: "empty", value: "", want: ""},
+		{name: "trailing separator", value: "ethernet-1/", want: "ethernet-1"},
+		{name: "leading separator", value: "/leaf1", want: "leaf1"},
+		{name: "truncated", value: strings.Repeat("a", 70), want: strings.Repeat("a", 63)},
+		{name: "truncated at a separator", value: strings.Repeat("a", 61) + "-._b", want: strings.Repeat("a", 61)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LabelValue(tt.value); got != tt.want {
+				t.Errorf("LabelValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
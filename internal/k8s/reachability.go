@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// fieldManager owns the fields kbutler applies to custom resources
+	fieldManager = "kbutler"
+)
+
+// ServiceReachabilityResource records the reachability of the external addresses of a service across the fabric,
+// one per LoadBalancer service and named after it
+var ServiceReachabilityResource = schema.GroupVersionResource{Group: "fabric.srlinux.io", Version: "v1alpha1", Resource: "servicereachabilities"}
+
+// ApplyServiceReachability creates or updates the ServiceReachability of a service with status. It is owned by the
+// service, so is garbage collected along with it. The status is applied through the status subresource once the resource exists
+func ApplyServiceReachability(ctx context.Context, client dynamic.Interface, service *v1.Service, status interface{}) error {
+	controller := true
+	object := map[string]interface{}{
+		"apiVersion": ServiceReachabilityResource.GroupVersion().String(),
+		"kind":       "ServiceReachability",
+		"metadata": metav1.ObjectMeta{
+			Name:      service.Name,
+			Namespace: service.Namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Name:       service.Name,
+				UID:        service.UID,
+				Controller: &controller,
+			}},
+		},
+	}
+	if err := applyServiceReachability(ctx, client, service.Namespace, service.Name, object); err != nil {
+		return err
+	}
+	object["status"] = status
+	return applyServiceReachability(ctx, client, service.Namespace, service.Name, object, "status")
+}
+
+// applyServiceReachability applies a ServiceReachability, or one of its subresources
+func applyServiceReachability(ctx context.Context, client dynamic.Interface, namespace string, name string, object map[string]interface{}, subresources ...string) error {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = client.Resource(ServiceReachabilityResource).Namespace(namespace).Patch(ctx, name, types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: fieldManager, Force: &force}, subresources...)
+	return err
+}
+
+// DeleteServiceReachability deletes the ServiceReachability of a service, if it exists
+func DeleteServiceReachability(ctx context.Context, client dynamic.Interface, namespace string, name string) error {
+	err := client.Resource(ServiceReachabilityResource).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
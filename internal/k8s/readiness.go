@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// RouteProgrammedCondition is the readiness gate set once the fabric has programmed a route to a service via the pod's node
+	RouteProgrammedCondition v1.PodConditionType = FabricAnnotationPrefix + "route-programmed"
+)
+
+// SetPodReadinessGate sets the condition of a readiness gate to True on a pod, if the pod declares the gate and it isn't already True.
+// The pod is expected to come from a lister, so no request is made unless the condition changes.
+// The condition is never set back to False, as other switches in the fabric may still be routing to the pod
+func SetPodReadinessGate(ctx context.Context, clientSet *kubernetes.Clientset, pod *v1.Pod, conditionType v1.PodConditionType, message string) error {
+	gateDeclared := false
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == conditionType {
+			gateDeclared = true
+		}
+	}
+	if !gateDeclared {
+		return nil
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == v1.ConditionTrue {
+			return nil
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.PodCondition{
+				{
+					Type:               conditionType,
+					Status:             v1.ConditionTrue,
+					LastTransitionTime: metav1.Now(),
+					Reason:             "RouteProgrammed",
+					Message:            message,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
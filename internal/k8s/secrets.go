@@ -0,0 +1,32 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BasicAuthSecret returns the username and password held by a Secret, given as namespace/name
+func BasicAuthSecret(ctx context.Context, clientSet *kubernetes.Clientset, secret string) (string, string, error) {
+	parts := strings.SplitN(secret, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("secret %q is not namespace/name", secret)
+	}
+	s, err := clientSet.CoreV1().Secrets(parts[0]).Get(ctx, parts[1], metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	username, ok := s.Data[v1.BasicAuthUsernameKey]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s has no %s", secret, v1.BasicAuthUsernameKey)
+	}
+	password, ok := s.Data[v1.BasicAuthPasswordKey]
+	if !ok {
+		return "", "", fmt.Errorf("secret %s has no %s", secret, v1.BasicAuthPasswordKey)
+	}
+	return string(username), string(password), nil
+}
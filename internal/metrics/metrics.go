@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/httpserver"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "kbutler"
+)
+
+var (
+	services = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "services",
+		Help:      "Number of services by oper-state.",
+	}, []string{"oper_state"})
+	externalAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "external_addresses",
+		Help:      "Number of external addresses via each host by oper-state and reason.",
+	}, []string{"oper_state", "reason"})
+	informerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "informer_events_total",
+		Help:      "Number of informer events handled by each controller.",
+	}, []string{"controller", "event"})
+	gnmiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gnmi_request_duration_seconds",
+		Help:      "Latency of gNMI requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	gnmiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gnmi_errors_total",
+		Help:      "Number of failed gNMI requests.",
+	}, []string{"operation"})
+	telemetryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ndk_telemetry_request_duration_seconds",
+		Help:      "Latency of NDK telemetry requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	telemetryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ndk_telemetry_errors_total",
+		Help:      "Number of failed NDK telemetry requests.",
+	}, []string{"operation"})
+	telemetryWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telemetry_writes_total",
+		Help:      "Number of telemetry writes, sent to NDK or suppressed as unchanged.",
+	}, []string{"result"})
+	reconcileAge = &reconcileCollector{
+		desc:      prometheus.NewDesc(namespace+"_seconds_since_last_reconcile", "Time since each controller last completed a full reconcile, or went through an informer resync.", []string{"controller"}, nil),
+		completed: make(map[string]time.Time),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(services, externalAddresses, informerEvents, gnmiDuration, gnmiErrors, telemetryDuration, telemetryErrors, telemetryWrites, reconcileAge)
+}
+
+// stateTracker counts objects by state, so gauges can be kept up to date as individual objects change state
+type stateTracker struct {
+	mu     sync.Mutex
+	states map[string][]string
+	gauge  *prometheus.GaugeVec
+}
+
+// set records the state of an object, an empty state removes the object
+func (t *stateTracker) set(key string, state ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.states[key]; ok {
+		t.gauge.WithLabelValues(old...).Dec()
+		delete(t.states, key)
+	}
+	if len(state) == 0 || state[0] == "" {
+		return
+	}
+	t.states[key] = state
+	t.gauge.WithLabelValues(state...).Inc()
+}
+
+var (
+	serviceStates         = &stateTracker{states: make(map[string][]string), gauge: services}
+	externalAddressStates = &stateTracker{states: make(map[string][]string), gauge: externalAddresses}
+)
+
+// ServiceState records the oper-state of a service, an empty state removes the service
+func ServiceState(key string, state string) {
+	serviceStates.set(key, state)
+}
+
+// ExternalAddressState records the oper-state and reason of an external address via a host, an empty state removes it
+func ExternalAddressState(key string, state string, reason string) {
+	if state == "" {
+		externalAddressStates.set(key)
+		return
+	}
+	externalAddressStates.set(key, state, reason)
+}
+
+// InformerEvent counts an informer event handled by a controller
+func InformerEvent(controller string, event string) {
+	informerEvents.WithLabelValues(controller, event).Inc()
+}
+
+// ObserveGNMI records the latency and outcome of a gNMI request started at start
+func ObserveGNMI(operation string, start time.Time, err error) {
+	gnmiDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		gnmiErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// ObserveTelemetry records the latency and outcome of an NDK telemetry request started at start
+func ObserveTelemetry(operation string, start time.Time, failed bool) {
+	telemetryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if failed {
+		telemetryErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// TelemetryWrite counts a telemetry write, either sent to NDK or suppressed as unchanged
+func TelemetryWrite(suppressed bool) {
+	if suppressed {
+		telemetryWrites.WithLabelValues("suppressed").Inc()
+		return
+	}
+	telemetryWrites.WithLabelValues("sent").Inc()
+}
+
+// reconcileCollector reports the time since each controller last completed a full reconcile, computed when scraped
+type reconcileCollector struct {
+	mu        sync.Mutex
+	desc      *prometheus.Desc
+	completed map[string]time.Time
+}
+
+func (c *reconcileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *reconcileCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for controller, completed := range c.completed {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(completed).Seconds(), controller)
+	}
+}
+
+// ReconcileCompleted records that a controller completed a full reconcile, or that its informer resynced all objects
+func ReconcileCompleted(controller string) {
+	reconcileAge.mu.Lock()
+	defer reconcileAge.mu.Unlock()
+	reconcileAge.completed[controller] = time.Now()
+}
+
+var server = httpserver.New("metrics", metricsHandler())
+
+// metricsHandler serves metrics at /metrics
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// Listen serves metrics on address at /metrics, replacing any server on a different address. An empty address stops serving
+func Listen(address string) {
+	server.Listen(address)
+}
@@ -0,0 +1,148 @@
+package nodemgr
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+
+	log "k8s.io/klog"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// lldpNeighbor is a neighbor learnt via LLDP on an interface of this switch
+type lldpNeighbor struct {
+	Interface  string
+	ChassisID  string
+	SystemName string
+	PortID     string
+	// ManagementAddresses are not carried by NDK notifications, they are retrieved via gNMI once the neighbor changes
+	ManagementAddresses []string
+	addressesFetched    bool
+}
+
+var (
+	// lldpMu guards the LLDP neighbors, which are updated from the notification stream
+	lldpMu sync.Mutex
+	// lldpNeighbors holds the LLDP neighbors of this switch, keyed by interface and chassis ID
+	lldpNeighbors = make(map[string]lldpNeighbor)
+)
+
+// lldpNeighborChanged records an LLDP neighbor, triggering a reconcile of nodes
+func (c *NodeController) lldpNeighborChanged(notification *protos.LldpNeighborNotification) {
+	neighbor := lldpNeighbor{
+		Interface:  notification.GetKey().GetInterfaceName(),
+		ChassisID:  notification.GetKey().GetChassisId(),
+		SystemName: notification.GetData().GetSystemName(),
+		PortID:     notification.GetData().GetPortId(),
+	}
+	key := neighbor.Interface + "/" + neighbor.ChassisID
+	lldpMu.Lock()
+	if notification.GetOp() == protos.SdkMgrOperation_Delete {
+		delete(lldpNeighbors, key)
+	} else {
+		// Addresses last retrieved are kept until they are refreshed
+		neighbor.ManagementAddresses = lldpNeighbors[key].ManagementAddresses
+		lldpNeighbors[key] = neighbor
+	}
+	lldpMu.Unlock()
+	c.triggerReconcile()
+}
+
+// refreshManagementAddresses retrieves the management addresses of LLDP neighbors that changed since they were last retrieved.
+// Neighbors that fail are retried on the next call
+func refreshManagementAddresses() {
+	lldpMu.Lock()
+	var stale []lldpNeighbor
+	for _, neighbor := range lldpNeighbors {
+		if !neighbor.addressesFetched {
+			stale = append(stale, neighbor)
+		}
+	}
+	lldpMu.Unlock()
+
+	for _, neighbor := range stale {
+		addresses, err := fabric.LLDPManagementAddresses(neighbor.Interface, neighbor.ChassisID)
+		if err != nil {
+			log.Errorf("Failed to retrieve LLDP management addresses on interface: %s: %v", neighbor.Interface, err)
+			continue
+		}
+		key := neighbor.Interface + "/" + neighbor.ChassisID
+		lldpMu.Lock()
+		// The neighbor may have changed or gone while its addresses were retrieved
+		if current, ok := lldpNeighbors[key]; ok && !current.addressesFetched {
+			current.ManagementAddresses = addresses
+			current.addressesFetched = true
+			lldpNeighbors[key] = current
+		}
+		lldpMu.Unlock()
+	}
+}
+
+// shortName returns the first label of a hostname
+func shortName(name string) string {
+	return strings.ToLower(strings.SplitN(name, ".", 2)[0])
+}
+
+// neighborMatch checks if an LLDP neighbor is a node, by system name or management address, returning what it matched by
+func neighborMatch(neighbor lldpNeighbor, node *v1.Node) string {
+	if neighbor.SystemName != "" && shortName(neighbor.SystemName) == shortName(node.Name) {
+		return "system-name"
+	}
+	for _, address := range node.Status.Addresses {
+		if fabric.ContainsAddress(neighbor.ManagementAddresses, address.Address) {
+			return "management-address"
+		}
+	}
+	return ""
+}
+
+// nodeInterfaces returns the interfaces of this switch a node is attached to, according to LLDP
+func nodeInterfaces(node *v1.Node) []config.NodeInterface {
+	lldpMu.Lock()
+	neighbors := make([]lldpNeighbor, 0, len(lldpNeighbors))
+	for _, neighbor := range lldpNeighbors {
+		neighbors = append(neighbors, neighbor)
+	}
+	lldpMu.Unlock()
+
+	var interfaces []config.NodeInterface
+	for _, neighbor := range neighbors {
+		matchedBy := neighborMatch(neighbor, node)
+		if matchedBy == "" {
+			continue
+		}
+		var nodeInterface config.NodeInterface
+		nodeInterface.Name = neighbor.Interface
+		nodeInterface.ChassisID.Value = neighbor.ChassisID
+		nodeInterface.SystemName.Value = neighbor.SystemName
+		nodeInterface.PortID.Value = neighbor.PortID
+		nodeInterface.MatchedBy.Value = matchedBy
+		operState, err := fabric.InterfaceOperState(neighbor.Interface)
+		if err != nil {
+			log.Errorf("Failed to retrieve oper-state of interface: %s: %v", neighbor.Interface, err)
+		}
+		nodeInterface.OperState.Value = operState
+		interfaces = append(interfaces, nodeInterface)
+	}
+	sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Name < interfaces[j].Name })
+	return interfaces
+}
+
+// NodeInterfaces returns the names of the interfaces of this switch a node is attached to, as last published
+func NodeInterfaces(name string) []string {
+	KButler.RLock()
+	defer KButler.RUnlock()
+	var interfaces []string
+	if nodeData, ok := KButler.YangNode[name]; ok {
+		for _, nodeInterface := range nodeData.Interface {
+			interfaces = append(interfaces, nodeInterface.Name)
+		}
+	}
+	return interfaces
+}
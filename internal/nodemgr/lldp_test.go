@@ -0,0 +1,56 @@
+package nodemgr
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNeighborMatch(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-1.cluster.local"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "192.0.2.21"},
+				{Type: v1.NodeHostName, Address: "worker-1"},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		neighbor lldpNeighbor
+		want     string
+	}{
+		{
+			name:     "system name",
+			neighbor: lldpNeighbor{Interface: "ethernet-1/1", SystemName: "worker-1"},
+			want:     "system-name",
+		},
+		{
+			name:     "system name with another domain and case",
+			neighbor: lldpNeighbor{Interface: "ethernet-1/1", SystemName: "Worker-1.example.com"},
+			want:     "system-name",
+		},
+		{
+			name:     "management address",
+			neighbor: lldpNeighbor{Interface: "ethernet-1/1", SystemName: "localhost", ManagementAddresses: []string{"198.51.100.1", "192.0.2.21"}},
+			want:     "management-address",
+		},
+		{
+			name:     "management address not yet retrieved",
+			neighbor: lldpNeighbor{Interface: "ethernet-1/1", SystemName: "localhost"},
+		},
+		{
+			name:     "other node",
+			neighbor: lldpNeighbor{Interface: "ethernet-1/2", SystemName: "worker-2", ManagementAddresses: []string{"192.0.2.22"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := neighborMatch(tt.neighbor, node); got != tt.want {
+				t.Errorf("neighborMatch() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
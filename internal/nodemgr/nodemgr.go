@@ -0,0 +1,371 @@
+package nodemgr
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/brwallis/srlinux-go/pkg/ndk/nokia.com/srlinux/sdk/protos"
+	srlyangrelease "github.com/brwallis/srlinux-go/pkg/yangrelease"
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+
+	log "k8s.io/klog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// reconcileInterval is how often the switch's view of each node is refreshed
+	reconcileInterval = 10 * time.Second
+)
+
+var (
+	KButler   *agent.Agent
+	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+
+	// attachedNodes holds the interface each node attached to this switch was last seen on,
+	// nodes continue to be reported on after their neighbor entry is lost
+	attachedNodes = make(map[string]string)
+	// nodesMu serializes processing of nodes between the informer and the periodic reconcile
+	nodesMu sync.Mutex
+)
+
+// NodeController struct
+type NodeController struct {
+	informerFactory informers.SharedInformerFactory
+	nodeInformer    coreinformers.NodeInformer
+	trigger         chan struct{}
+}
+
+// getInternalIP returns the InternalIP address of a node
+func getInternalIP(node *v1.Node) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// fabricReachability computes the reachability of a node from this switch, based on the state of the interface the node is attached to,
+// the ARP/ND entry for the node and the state of any BGP session with the node. Returns false if the node is not attached to this switch
+func fabricReachability(node *v1.Node) (bool, v1.ConditionStatus, string, string, error) {
+	nodeAddress := getInternalIP(node)
+	if nodeAddress == "" {
+		return false, "", "", "", nil
+	}
+	interfaceName, subinterfaceIndex, neighborFound, err := fabric.Neighbor(nodeAddress)
+	if err != nil {
+		return false, "", "", "", err
+	}
+	sessionState, bgpConfigured, err := fabric.BGPSessionState(nodeAddress)
+	if err != nil {
+		return false, "", "", "", err
+	}
+
+	lastInterface, attached := attachedNodes[node.Name]
+	if neighborFound {
+		attachedNodes[node.Name] = interfaceName
+	} else if bgpConfigured && !attached {
+		attachedNodes[node.Name] = ""
+	}
+	if !neighborFound && !bgpConfigured && !attached {
+		return false, "", "", "", nil
+	}
+	if !neighborFound {
+		interfaceName = lastInterface
+	}
+
+	if interfaceName != "" {
+		operState, err := fabric.InterfaceOperState(interfaceName)
+		if err != nil {
+			return false, "", "", "", err
+		}
+		if operState != "up" {
+			return true, v1.ConditionFalse, "InterfaceDown", fmt.Sprintf("Interface %s on %s towards %s is %s", interfaceName, KButler.Hostname, nodeAddress, operState), nil
+		}
+	}
+	if !neighborFound {
+		return true, v1.ConditionFalse, "NeighborMissing", fmt.Sprintf("No ARP/ND entry for %s on %s", nodeAddress, KButler.Hostname), nil
+	}
+	if bgpConfigured && sessionState != "established" {
+		return true, v1.ConditionFalse, "BGPSessionDown", fmt.Sprintf("BGP session with %s on %s is %s", nodeAddress, KButler.Hostname, sessionState), nil
+	}
+	return true, v1.ConditionTrue, "FabricReachable", fmt.Sprintf("Reachable via %s.%s on %s", interfaceName, subinterfaceIndex, KButler.Hostname), nil
+}
+
+// getPodCIDRs returns the pod CIDRs allocated to a node
+func getPodCIDRs(node *v1.Node) []string {
+	if len(node.Spec.PodCIDRs) > 0 {
+		return node.Spec.PodCIDRs
+	}
+	if node.Spec.PodCIDR != "" {
+		return []string{node.Spec.PodCIDR}
+	}
+	return nil
+}
+
+// checkPodCIDRs looks up the route for each pod CIDR of a node, checking it is programmed with the node as next hop
+func checkPodCIDRs(node *v1.Node, dev *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable) []config.PodCIDR {
+	var podCIDRs []config.PodCIDR
+	nodeAddress := getInternalIP(node)
+	for _, prefix := range getPodCIDRs(node) {
+		var podCIDR config.PodCIDR
+		routeMatched, routeProgrammed, nextHops := fabric.RouteNextHops(dev, prefix)
+		podCIDR.Prefix = prefix
+		podCIDR.RoutePresent.Value = routeMatched
+		podCIDR.FIBProgrammed.Value = routeProgrammed
+		podCIDR.NextHopMatches.Value = nodeAddress != "" && fabric.ContainsAddress(nextHops, nodeAddress)
+		switch {
+		case !podCIDR.RoutePresent.Value:
+			podCIDR.OperState.Value = "down"
+			podCIDR.OperReason.Value = "pod-cidr-no-route"
+		case !podCIDR.FIBProgrammed.Value:
+			podCIDR.OperState.Value = "down"
+			podCIDR.OperReason.Value = "pod-cidr-not-programmed"
+		case !podCIDR.NextHopMatches.Value:
+			podCIDR.OperState.Value = "down"
+			podCIDR.OperReason.Value = "node-nexthop-missing"
+		default:
+			podCIDR.OperState.Value = "up"
+		}
+		podCIDRs = append(podCIDRs, podCIDR)
+	}
+	return podCIDRs
+}
+
+// processNetworkUnavailable clears the NetworkUnavailable condition of a node once all of its pod CIDRs are routed via the node.
+// A condition already cleared as RouteCreated, by this or any other switch the node is attached to, is left untouched
+func processNetworkUnavailable(node *v1.Node, podCIDRs []config.PodCIDR) {
+	if len(podCIDRs) == 0 {
+		return
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeNetworkUnavailable && condition.Status == v1.ConditionFalse && condition.Reason == "RouteCreated" {
+			return
+		}
+	}
+	for _, podCIDR := range podCIDRs {
+		if podCIDR.OperState.Value != "up" {
+			log.Infof("Node: %s pod CIDR: %s not yet routed via the node, leaving %s untouched", node.Name, podCIDR.Prefix, v1.NodeNetworkUnavailable)
+			return
+		}
+	}
+	if err := k8s.SetNodeCondition(Ctx, ClientSet, node, v1.NodeNetworkUnavailable, v1.ConditionFalse, "RouteCreated", "Pod CIDRs routed via the node by the fabric"); err != nil {
+		log.Errorf("Failed to clear %s condition on node: %s: %v", v1.NodeNetworkUnavailable, node.Name, err)
+	}
+}
+
+// publishNode publishes the state of the pod CIDR routes and interfaces of a node, only updating telemetry if the state has changed
+func publishNode(node *v1.Node, podCIDRs []config.PodCIDR, interfaces []config.NodeInterface) {
+	var nodeData config.Node
+	nodeData.Address.Value = getInternalIP(node)
+	nodeData.PodCIDR = podCIDRs
+	nodeData.Interface = interfaces
+	KButler.Lock()
+	defer KButler.Unlock()
+	oldNodeData, ok := KButler.YangNode[node.Name]
+	if ok && reflect.DeepEqual(*oldNodeData, nodeData) {
+		return
+	}
+	KButler.YangNode[node.Name] = &nodeData
+	KButler.UpdateNodeTelemetry(node.Name, oldNodeData)
+}
+
+// processPlacement labels a node with the interfaces of this switch it is attached to, when enabled in config.
+// A node already labelled by another switch is left untouched, and labels set by this switch are removed once the node is no longer attached
+func processPlacement(node *v1.Node, interfaces []config.NodeInterface) {
+	owner := node.Labels[k8s.SwitchLabel]
+	switchName := k8s.LabelValue(KButler.Hostname)
+	var placement k8s.FabricPlacement
+	cfg := KButler.Config()
+	if cfg.NodeLabels.Value && len(interfaces) > 0 {
+		if owner != "" && owner != switchName {
+			return
+		}
+		placement.Switch = KButler.Hostname
+		placement.Rack = cfg.Rack.Value
+		for _, nodeInterface := range interfaces {
+			placement.Ports = append(placement.Ports, nodeInterface.Name)
+		}
+	} else if owner != switchName {
+		return
+	}
+	if err := k8s.PatchNodeFabricPlacement(Ctx, ClientSet, node, placement); err != nil {
+		log.Errorf("Failed to label node: %s with its fabric placement: %v", node.Name, err)
+	}
+}
+
+// processNode publishes the state of a node and updates its FabricReachable and NetworkUnavailable conditions
+func processNode(node *v1.Node, dev *srlyangrelease.SrlNokiaNetworkInstance_NetworkInstance_RouteTable) {
+	var podCIDRs []config.PodCIDR
+	if dev != nil {
+		podCIDRs = checkPodCIDRs(node, dev)
+		if KButler.Config().ManageNetworkUnavailable.Value {
+			processNetworkUnavailable(node, podCIDRs)
+		}
+	} else {
+		// Keep the last known state of the pod CIDRs
+		KButler.RLock()
+		if oldNodeData, ok := KButler.YangNode[node.Name]; ok {
+			podCIDRs = oldNodeData.PodCIDR
+		}
+		KButler.RUnlock()
+	}
+	interfaces := nodeInterfaces(node)
+	publishNode(node, podCIDRs, interfaces)
+	processPlacement(node, interfaces)
+
+	attached, status, reason, message, err := fabricReachability(node)
+	if err != nil {
+		log.Errorf("Failed to determine fabric reachability of node: %s: %v", node.Name, err)
+		return
+	}
+	if !attached {
+		return
+	}
+	log.Infof("Node: %s fabric reachability: %s, reason: %s, %s", node.Name, status, reason, message)
+	conditionType := k8s.FabricReachableConditionType(KButler.Hostname)
+	if err := k8s.SetNodeCondition(Ctx, ClientSet, node, conditionType, status, reason, message); err != nil {
+		log.Errorf("Failed to set %s condition on node: %s: %v", conditionType, node.Name, err)
+	}
+}
+
+// processNodes processes a list of nodes against the current route table
+func processNodes(nodes []*v1.Node) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	refreshManagementAddresses()
+	// Routes are skipped if the route table is unavailable, reachability is still processed
+	dev, err := fabric.RouteTable()
+	if err != nil {
+		log.Errorf("Received error while getting route table: %v", err)
+	}
+	for _, node := range nodes {
+		processNode(node, dev)
+	}
+}
+
+// reconcile processes all nodes known to the informer
+func (c *NodeController) reconcile() {
+	nodes, err := c.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		log.Errorf("Failed to list nodes: %v", err)
+		return
+	}
+	processNodes(nodes)
+	metrics.ReconcileCompleted("nodemgr")
+}
+
+// triggerReconcile requests a reconcile, coalescing requests made while one is pending
+func (c *NodeController) triggerReconcile() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *NodeController) Run(ctx context.Context) error {
+	// Starts all the shared informers that have been created by the factory so far
+	c.informerFactory.Start(ctx.Done())
+	// wait for the initial synchronization of the local cache
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.nodeInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
+	}
+	return nil
+}
+
+func (c *NodeController) nodeAdd(obj interface{}) {
+	node := obj.(*v1.Node)
+	log.Infof("Node CREATED: %s", node.Name)
+	metrics.InformerEvent("nodemgr", "add")
+	processNodes([]*v1.Node{node})
+}
+
+func (c *NodeController) nodeDelete(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	log.Infof("Node DELETED: %s", node.Name)
+	metrics.InformerEvent("nodemgr", "delete")
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	delete(attachedNodes, node.Name)
+	KButler.Lock()
+	defer KButler.Unlock()
+	if _, ok := KButler.YangNode[node.Name]; ok {
+		KButler.DeleteNode(node.Name)
+	}
+}
+
+// NewNodeController creates a NodeController
+func NewNodeController(informerFactory informers.SharedInformerFactory) *NodeController {
+	nodeInformer := informerFactory.Core().V1().Nodes()
+
+	c := &NodeController{
+		informerFactory: informerFactory,
+		nodeInformer:    nodeInformer,
+		trigger:         make(chan struct{}, 1),
+	}
+	health.WatchInformer("nodemgr/nodes", nodeInformer.Informer())
+	nodeInformer.Informer().AddEventHandler(
+		// Node status is updated frequently by the kubelet, so updates are handled by the periodic reconcile instead
+		cache.ResourceEventHandlerFuncs{
+			// Called on creation
+			AddFunc: c.nodeAdd,
+			// Called on resource deletion.
+			DeleteFunc: c.nodeDelete,
+		},
+	)
+	return c
+}
+
+// NodeMgr manages the fabric view of Nodes from K8
+func NodeMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+	KButler = kButler
+	ClientSet = clientSet
+	Ctx = ctx
+	defer KButler.Wg.Done()
+
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
+	controller := NewNodeController(informerFactory)
+
+	if !KButler.SyncCaches(ctx, "nodemgr", func() error { return controller.Run(ctx) }) {
+		return
+	}
+	KButler.CacheSync.Done()
+	// Interface changes may affect the reachability of nodes attached to them
+	KButler.RegisterInterfaceHandler(func(notification *protos.InterfaceNotification) { controller.triggerReconcile() })
+	KButler.RegisterLLDPNeighborHandler(controller.lldpNeighborChanged)
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		controller.reconcile()
+		select {
+		case <-controller.trigger:
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Infof("Stopping NodeMgr...")
+			return
+		}
+	}
+}
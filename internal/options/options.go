@@ -0,0 +1,351 @@
+package options
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+
+	log "k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// Options are the parameters kbutler is started with, as opposed to its YANG configuration.
+// They are taken from, in increasing order of precedence, built-in defaults, the options file,
+// environment variables and command-line flags
+type Options struct {
+	NDKAddress string `json:"ndk-address"`
+	AgentName  string `json:"agent-name"`
+	YangRoot   string `json:"yang-root"`
+	// Standalone runs kbutler without NDK, monitoring the switch at GNMITarget and keeping its state in the HTTP API.
+	// The configuration of the switch is never written, so network policy ACLs and BFD are not available
+	Standalone   bool     `json:"standalone"`
+	ResyncPeriod Duration `json:"resync-period"`
+	GNMITarget   string   `json:"gnmi-target"`
+	// GNMITLSCA, GNMITLSCert and GNMITLSKey secure the connection to the gNMI server, which is plaintext if none are set
+	GNMITLSCA      string `json:"gnmi-tls-ca"`
+	GNMITLSCert    string `json:"gnmi-tls-cert"`
+	GNMITLSKey     string `json:"gnmi-tls-key"`
+	GNMISkipVerify bool   `json:"gnmi-skip-verify"`
+	// Credentials used towards the gNMI server are required, there are none built in
+	GNMIUsername string `json:"gnmi-username"`
+	GNMIPassword string `json:"gnmi-password"`
+	// GNMICredentialsFile is a YAML file with a username and password, overriding GNMIUsername and GNMIPassword
+	GNMICredentialsFile string `json:"gnmi-credentials-file"`
+	// GNMICredentialsSecret is the namespace/name of a basic-auth Secret, overriding the other credentials once Kubernetes is reachable
+	GNMICredentialsSecret string `json:"gnmi-credentials-secret"`
+	// Fleet lists the switches evaluated in fleet mode, only settable in the options file
+	Fleet []FleetSwitch `json:"fleet"`
+	// FleetInterval is how often the route table of each switch in the fleet is retrieved
+	FleetInterval Duration `json:"fleet-interval"`
+	Verbosity     int      `json:"verbosity"`
+	KubeConfig    string   `json:"kubeconfig"`
+	// KubernetesServiceHost and KubernetesServicePort locate the API server when running in a cluster
+	KubernetesServiceHost string `json:"kubernetes-service-host"`
+	KubernetesServicePort string `json:"kubernetes-service-port"`
+	// Defaults are YANG configuration leaves, keyed by leaf name, used until they are configured
+	Defaults map[string]interface{} `json:"defaults"`
+}
+
+// FleetSwitch is a switch evaluated in fleet mode, reached with the gNMI TLS options and credentials
+type FleetSwitch struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	// Role is leaf or spine
+	Role string `json:"role"`
+}
+
+// option is a parameter settable via the options file, an environment variable and a flag
+type option struct {
+	name  string
+	env   string
+	usage string
+	value func(o *Options) flag.Value
+}
+
+var options = []option{
+	{"ndk-address", "KBUTLER_NDK_ADDRESS", "address of the NDK service manager", func(o *Options) flag.Value { return (*stringValue)(&o.NDKAddress) }},
+	{"agent-name", "KBUTLER_AGENT_NAME", "name kbutler registers with NDK as", func(o *Options) flag.Value { return (*stringValue)(&o.AgentName) }},
+	{"yang-root", "KBUTLER_YANG_ROOT", "path of the kbutler YANG container", func(o *Options) flag.Value { return (*stringValue)(&o.YangRoot) }},
+	{"standalone", "KBUTLER_STANDALONE", "run without NDK, monitoring the switch at gnmi-target over gNMI only", func(o *Options) flag.Value { return (*boolValue)(&o.Standalone) }},
+	{"resync-period", "KBUTLER_RESYNC_PERIOD", "resync period of Kubernetes informers", func(o *Options) flag.Value { return &o.ResyncPeriod }},
+	{"gnmi-target", "KBUTLER_GNMI_TARGET", "address of the gNMI server of the switch", func(o *Options) flag.Value { return (*stringValue)(&o.GNMITarget) }},
+	{"gnmi-tls-ca", "KBUTLER_GNMI_TLS_CA", "CA certificate verifying the gNMI server, enables TLS", func(o *Options) flag.Value { return (*stringValue)(&o.GNMITLSCA) }},
+	{"gnmi-tls-cert", "KBUTLER_GNMI_TLS_CERT", "client certificate presented to the gNMI server, enables TLS", func(o *Options) flag.Value { return (*stringValue)(&o.GNMITLSCert) }},
+	{"gnmi-tls-key", "KBUTLER_GNMI_TLS_KEY", "key of the client certificate presented to the gNMI server", func(o *Options) flag.Value { return (*stringValue)(&o.GNMITLSKey) }},
+	{"gnmi-skip-verify", "KBUTLER_GNMI_SKIP_VERIFY", "do not verify the certificate of the gNMI server, enables TLS", func(o *Options) flag.Value { return (*boolValue)(&o.GNMISkipVerify) }},
+	{"gnmi-username", "KBUTLER_GNMI_USERNAME", "username used towards the gNMI server", func(o *Options) flag.Value { return (*stringValue)(&o.GNMIUsername) }},
+	{"gnmi-password", "KBUTLER_GNMI_PASSWORD", "password used towards the gNMI server", func(o *Options) flag.Value { return (*stringValue)(&o.GNMIPassword) }},
+	{"gnmi-credentials-file", "KBUTLER_GNMI_CREDENTIALS_FILE", "YAML file with the username and password used towards the gNMI server", func(o *Options) flag.Value { return (*stringValue)(&o.GNMICredentialsFile) }},
+	{"gnmi-credentials-secret", "KBUTLER_GNMI_CREDENTIALS_SECRET", "namespace/name of a basic-auth Secret with the credentials used towards the gNMI server", func(o *Options) flag.Value { return (*stringValue)(&o.GNMICredentialsSecret) }},
+	{"fleet-interval", "KBUTLER_FLEET_INTERVAL", "how often the route table of each switch in the fleet is retrieved", func(o *Options) flag.Value { return &o.FleetInterval }},
+	{"verbosity", "KBUTLER_VERBOSITY", "log verbosity", func(o *Options) flag.Value { return (*intValue)(&o.Verbosity) }},
+	{"kubeconfig", "KUBERNETES_CONFIG", "kubeconfig file used when not running in a cluster", func(o *Options) flag.Value { return (*stringValue)(&o.KubeConfig) }},
+	{"kubernetes-service-host", "KUBERNETES_SERVICE_HOST", "host of the Kubernetes API server when running in a cluster", func(o *Options) flag.Value { return (*stringValue)(&o.KubernetesServiceHost) }},
+	{"kubernetes-service-port", "KUBERNETES_SERVICE_PORT", "port of the Kubernetes API server when running in a cluster", func(o *Options) flag.Value { return (*stringValue)(&o.KubernetesServicePort) }},
+}
+
+// Default returns the options used when none are given
+func Default() Options {
+	return Options{
+		NDKAddress:    "unix:///opt/srlinux/var/run/sr_sdk_service_manager:50053",
+		AgentName:     "kbutler",
+		YangRoot:      ".kbutler",
+		ResyncPeriod:  Duration(24 * time.Hour),
+		FleetInterval: Duration(30 * time.Second),
+		GNMITarget:    fabric.DefaultGNMITarget,
+	}
+}
+
+// Load parses the command line, merging flags with the options file and environment variables
+func Load(args []string) (Options, error) {
+	opts := Default()
+	flagOpts := Default()
+	var file string
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.StringVar(&file, "config-file", os.Getenv("KBUTLER_CONFIG_FILE"), "YAML options file, options are named as their flags (env KBUTLER_CONFIG_FILE)")
+	for _, o := range options {
+		fs.Var(o.value(&flagOpts), o.name, fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return opts, err
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return opts, err
+		}
+		if err := yaml.Unmarshal(data, &opts); err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", file, err)
+		}
+	}
+	for _, o := range options {
+		if value, ok := os.LookupEnv(o.env); ok && value != "" {
+			if err := o.value(&opts).Set(value); err != nil {
+				return opts, fmt.Errorf("invalid %s: %v", o.env, err)
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.name == f.Name {
+				o.value(&opts).Set(o.value(&flagOpts).String())
+			}
+		}
+	})
+	return opts, nil
+}
+
+// Validate checks the options are consistent, before any of them are applied
+func (o Options) Validate() error {
+	// The default target is the gNMI server of the switch kbutler is installed on, which it is not in standalone mode
+	if o.Standalone && o.GNMITarget == fabric.DefaultGNMITarget {
+		return fmt.Errorf("standalone mode requires gnmi-target")
+	}
+	if o.GNMIUsername == "" && o.GNMICredentialsFile == "" && o.GNMICredentialsSecret == "" {
+		return fmt.Errorf("gNMI credentials require gnmi-username and gnmi-password, gnmi-credentials-file or gnmi-credentials-secret")
+	}
+	return o.validateFleet()
+}
+
+// Apply validates, then applies the options that take effect process wide
+func (o Options) Apply() error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	// The in-cluster Kubernetes configuration is only taken from the environment
+	if o.KubernetesServiceHost != "" && o.KubernetesServicePort != "" {
+		os.Setenv("KUBERNETES_SERVICE_HOST", o.KubernetesServiceHost)
+		os.Setenv("KUBERNETES_SERVICE_PORT", o.KubernetesServicePort)
+	}
+	gnmiConfig, err := o.GNMIConfig()
+	if err != nil {
+		return err
+	}
+	client, err := fabric.NewGNMIClient(gnmiConfig)
+	if err != nil {
+		return err
+	}
+	fabric.SetGNMIClient(client)
+	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	log.InitFlags(klogFlags)
+	return klogFlags.Set("v", strconv.Itoa(o.Verbosity))
+}
+
+// validateFleet checks each switch of the fleet has a unique name, a target and a known role
+func (o Options) validateFleet() error {
+	if len(o.Fleet) > 0 && !o.Standalone {
+		return fmt.Errorf("fleet requires standalone mode")
+	}
+	names := make(map[string]bool)
+	for _, s := range o.Fleet {
+		if s.Name == "" || s.Target == "" {
+			return fmt.Errorf("fleet switch %q requires a name and target", s.Name)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("fleet switch %s listed more than once", s.Name)
+		}
+		names[s.Name] = true
+		if s.Role != fabric.RoleLeaf && s.Role != fabric.RoleSpine {
+			return fmt.Errorf("fleet switch %s has role %q, not %s or %s", s.Name, s.Role, fabric.RoleLeaf, fabric.RoleSpine)
+		}
+	}
+	return nil
+}
+
+// credentials are the username and password in a gNMI credentials file
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// GNMIConfig returns how to reach the gNMI server, reading the credentials file if set
+func (o Options) GNMIConfig() (fabric.GNMIConfig, error) {
+	cfg := fabric.GNMIConfig{
+		Target:     o.GNMITarget,
+		TLSCA:      o.GNMITLSCA,
+		TLSCert:    o.GNMITLSCert,
+		TLSKey:     o.GNMITLSKey,
+		SkipVerify: o.GNMISkipVerify,
+		Username:   o.GNMIUsername,
+		Password:   o.GNMIPassword,
+	}
+	if o.GNMICredentialsFile == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(o.GNMICredentialsFile)
+	if err != nil {
+		return cfg, err
+	}
+	var creds credentials
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return cfg, fmt.Errorf("unable to parse %s: %v", o.GNMICredentialsFile, err)
+	}
+	cfg.Username, cfg.Password = creds.Username, creds.Password
+	return cfg, nil
+}
+
+// String formats the options without the gNMI password, so they can be logged
+func (o Options) String() string {
+	if o.GNMIPassword != "" {
+		o.GNMIPassword = "<redacted>"
+	}
+	type plain Options
+	return fmt.Sprintf("%+v", plain(o))
+}
+
+// AgentConfig returns the YANG configuration used until kbutler is configured,
+// the built-in defaults overridden by the defaults in the options file
+func (o Options) AgentConfig() (config.AgentConfig, error) {
+	cfg := config.DefaultAgentConfig()
+	if len(o.Defaults) == 0 {
+		return cfg, nil
+	}
+	// Leaves are encoded as NDK encodes configuration, with underscores in names and values wrapped
+	leaves := make(map[string]interface{}, len(o.Defaults))
+	for name, value := range o.Defaults {
+		leaves[strings.ReplaceAll(name, "-", "_")] = wrapLeaf(value)
+	}
+	data, err := json.Marshal(leaves)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid defaults: %v", err)
+	}
+	return cfg, nil
+}
+
+// wrapLeaf wraps a leaf value, or each value of a leaf-list, the way NDK does
+func wrapLeaf(value interface{}) interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return map[string]interface{}{"value": value}
+	}
+	wrapped := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		wrapped = append(wrapped, map[string]interface{}{"value": item})
+	}
+	return wrapped
+}
+
+// Duration is a duration written as a string such as 24h, both in the options file and on the command line
+type Duration time.Duration
+
+func (d *Duration) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+// UnmarshalJSON parses a duration from the options file
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return d.Set(value)
+}
+
+// stringValue, intValue and boolValue implement flag.Value for the remaining types of options
+type (
+	stringValue string
+	intValue    int
+	boolValue   bool
+)
+
+func (s *stringValue) Set(value string) error {
+	*s = stringValue(value)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+func (i *intValue) Set(value string) error {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*i = intValue(v)
+	return nil
+}
+
+func (i *intValue) String() string {
+	return strconv.Itoa(int(*i))
+}
+
+func (b *boolValue) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(v)
+	return nil
+}
+
+func (b *boolValue) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+// IsBoolFlag allows boolean options to be given as a bare flag
+func (b *boolValue) IsBoolFlag() bool {
+	return true
+}
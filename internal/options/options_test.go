@@ -0,0 +1,214 @@
+package options
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		check   func(o Options) bool
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			check: func(o Options) bool {
+				return o.AgentName == "kbutler" && o.GNMITarget == fabric.DefaultGNMITarget && o.ResyncPeriod == Duration(24*time.Hour)
+			},
+		},
+		{
+			name: "options file",
+			file: "agent-name: file\nresync-period: 1h\nstandalone: true\n",
+			check: func(o Options) bool {
+				return o.AgentName == "file" && o.ResyncPeriod == Duration(time.Hour) && o.Standalone
+			},
+		},
+		{
+			name:  "environment overrides options file",
+			file:  "agent-name: file\nyang-root: .file\n",
+			env:   map[string]string{"KBUTLER_AGENT_NAME": "env"},
+			check: func(o Options) bool { return o.AgentName == "env" && o.YangRoot == ".file" },
+		},
+		{
+			name:  "empty environment variable is ignored",
+			file:  "agent-name: file\n",
+			env:   map[string]string{"KBUTLER_AGENT_NAME": ""},
+			check: func(o Options) bool { return o.AgentName == "file" },
+		},
+		{
+			name:  "flag overrides environment",
+			env:   map[string]string{"KBUTLER_AGENT_NAME": "env", "KBUTLER_VERBOSITY": "2"},
+			args:  []string{"--agent-name=flag"},
+			check: func(o Options) bool { return o.AgentName == "flag" && o.Verbosity == 2 },
+		},
+		{
+			name:  "bare boolean flag",
+			args:  []string{"--standalone"},
+			check: func(o Options) bool { return o.Standalone },
+		},
+		{
+			name:  "fleet from options file",
+			file:  "fleet:\n  - name: leaf1\n    target: leaf1:57400\n    role: leaf\n",
+			check: func(o Options) bool { return len(o.Fleet) == 1 && o.Fleet[0].Target == "leaf1:57400" },
+		},
+		{
+			name:    "invalid duration flag",
+			args:    []string{"--resync-period=daily"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid environment variable",
+			env:     map[string]string{"KBUTLER_VERBOSITY": "loud"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid options file",
+			file:    "resync-period: [1h]\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"--unknown"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"kbutler"}, tt.args...)
+			if tt.file != "" {
+				file := filepath.Join(t.TempDir(), "kbutler.yml")
+				if err := ioutil.WriteFile(file, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, "--config-file="+file)
+			}
+			for name, value := range tt.env {
+				previous, ok := os.LookupEnv(name)
+				os.Setenv(name, value)
+				defer func(name string) {
+					if ok {
+						os.Setenv(name, previous)
+					} else {
+						os.Unsetenv(name)
+					}
+				}(name)
+			}
+			got, err := Load(args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !tt.check(got) {
+				t.Errorf("Load() = %v", got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	leaf := FleetSwitch{Name: "leaf1", Target: "leaf1:57400", Role: fabric.RoleLeaf}
+	tests := []struct {
+		name    string
+		modify  func(o *Options)
+		wantErr bool
+	}{
+		{
+			name:   "credentials",
+			modify: func(o *Options) {},
+		},
+		{
+			name:    "no credentials",
+			modify:  func(o *Options) { o.GNMIUsername, o.GNMIPassword = "", "" },
+			wantErr: true,
+		},
+		{
+			name: "credentials file",
+			modify: func(o *Options) {
+				o.GNMIUsername, o.GNMIPassword, o.GNMICredentialsFile = "", "", "/etc/kbutler/gnmi.yml"
+			},
+		},
+		{
+			name: "credentials secret",
+			modify: func(o *Options) {
+				o.GNMIUsername, o.GNMIPassword, o.GNMICredentialsSecret = "", "", "kube-system/srlinux-kbutler-gnmi"
+			},
+		},
+		{
+			name:    "standalone without target",
+			modify:  func(o *Options) { o.Standalone = true },
+			wantErr: true,
+		},
+		{
+			name:   "standalone with target",
+			modify: func(o *Options) { o.Standalone, o.GNMITarget = true, "leaf1:57400" },
+		},
+		{
+			name:   "fleet",
+			modify: func(o *Options) { o.Standalone, o.GNMITarget, o.Fleet = true, "leaf1:57400", []FleetSwitch{leaf} },
+		},
+		{
+			name:    "fleet without standalone",
+			modify:  func(o *Options) { o.Fleet = []FleetSwitch{leaf} },
+			wantErr: true,
+		},
+		{
+			name:    "fleet switch listed twice",
+			modify:  func(o *Options) { o.Standalone, o.GNMITarget, o.Fleet = true, "leaf1:57400", []FleetSwitch{leaf, leaf} },
+			wantErr: true,
+		},
+		{
+			name: "fleet switch without target",
+			modify: func(o *Options) {
+				o.Standalone, o.GNMITarget, o.Fleet = true, "leaf1:57400", []FleetSwitch{{Name: "leaf1", Role: fabric.RoleLeaf}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "fleet switch with unknown role",
+			modify: func(o *Options) {
+				o.Standalone, o.GNMITarget, o.Fleet = true, "leaf1:57400", []FleetSwitch{{Name: "leaf1", Target: "leaf1:57400", Role: "border"}}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := Default()
+			o.GNMIUsername, o.GNMIPassword = "kbutler", "secret"
+			tt.modify(&o)
+			if err := o.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentConfig(t *testing.T) {
+	o := Default()
+	o.Defaults = map[string]interface{}{
+		"pending-timeout":    60,
+		"published-metadata": []interface{}{"team"},
+	}
+	cfg, err := o.AgentConfig()
+	if err != nil {
+		t.Fatalf("AgentConfig() error = %v", err)
+	}
+	if cfg.PendingTimeout.Value != 60 {
+		t.Errorf("pending-timeout = %d, want 60", cfg.PendingTimeout.Value)
+	}
+	if len(cfg.PublishedMetadata) != 1 || cfg.PublishedMetadata[0].Value != "team" {
+		t.Errorf("published-metadata = %v, want [team]", cfg.PublishedMetadata)
+	}
+	o.Defaults = map[string]interface{}{"pending-timeout": "soon"}
+	if _, err := o.AgentConfig(); err == nil {
+		t.Errorf("AgentConfig() with invalid defaults succeeded")
+	}
+}
@@ -0,0 +1,758 @@
+package policymgr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+
+	log "k8s.io/klog"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	networkinginformers "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// aclFilterName is the name of the IPv4 and IPv6 filters kbutler renders entries into
+	aclFilterName = "kbutler-network-policy"
+	// Each service with entries is allocated a block of sequenceBlockSize sequence ids from sequenceStart, numbering its entries consecutively.
+	// The final entry of each filter, at defaultSequenceID, accepts all other traffic
+	sequenceStart     = 10
+	sequenceBlockSize = 200
+	defaultSequenceID = 65535
+	maxSequenceBlocks = (defaultSequenceID - sequenceStart) / sequenceBlockSize
+	// reconcileInterval is how often the rendered ACLs are checked, picking up configuration changes and refreshing counters
+	reconcileInterval = 30 * time.Second
+	// restrictPortsAnnotation opts a service, or all services in a namespace, in to dropping traffic to ports it doesn't declare
+	restrictPortsAnnotation = k8s.FabricAnnotationPrefix + "restrict-ports"
+)
+
+var (
+	KButler   *agent.Agent
+	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+
+	// appliedEntries holds the entries currently applied to the switch, keyed by family and sequence id.
+	// It is seeded from the filters on the switch, so entries applied before a restart are removed once no longer rendered
+	appliedEntries = make(map[string]fabric.ACLEntry)
+	// entriesSeeded is set once appliedEntries has been seeded
+	entriesSeeded bool
+	// statisticsEnabled records the filter families per-entry statistics have been enabled on
+	statisticsEnabled = make(map[string]bool)
+	// foreignBindings holds the filters of others found bound to subinterfaces the filters are to be bound to, which are left untouched
+	foreignBindings = make(map[fabric.ACLBinding]string)
+	// sequenceBlocks holds the block of sequence ids allocated to each service with entries,
+	// so the entries of a service keep their sequence ids as other services come and go
+	sequenceBlocks = make(map[agent.ServiceKey]uint32)
+)
+
+// protocolNumbers maps Kubernetes protocols to IP protocol numbers
+var protocolNumbers = map[v1.Protocol]uint8{
+	v1.ProtocolTCP:  6,
+	v1.ProtocolUDP:  17,
+	v1.ProtocolSCTP: 132,
+}
+
+// PolicyController struct
+type PolicyController struct {
+	informerFactory   informers.SharedInformerFactory
+	policyInformer    networkinginformers.NetworkPolicyInformer
+	serviceInformer   coreinformers.ServiceInformer
+	namespaceInformer coreinformers.NamespaceInformer
+	podInformer       coreinformers.PodInformer
+	trigger           chan struct{}
+}
+
+// servicePort is a protocol and port exposed on the external address of a service
+type servicePort struct {
+	Protocol uint8
+	Port     uint16
+}
+
+// selectsService returns the pods backing a service that a NetworkPolicy restricts ingress to, if any
+func selectsService(policy *networkingv1.NetworkPolicy, service *v1.Service, pods []*v1.Pod) []*v1.Pod {
+	if policy.Namespace != service.Namespace {
+		return nil
+	}
+	ingress := len(policy.Spec.PolicyTypes) == 0
+	for _, policyType := range policy.Spec.PolicyTypes {
+		if policyType == networkingv1.PolicyTypeIngress {
+			ingress = true
+		}
+	}
+	if !ingress {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		log.Errorf("Invalid pod selector in NetworkPolicy: %s/%s: %v", policy.Namespace, policy.Name, err)
+		return nil
+	}
+	var selected []*v1.Pod
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			selected = append(selected, pod)
+		}
+	}
+	return selected
+}
+
+// backingPods returns the pods selected by a service
+func (c *PolicyController) backingPods(service *v1.Service) []*v1.Pod {
+	if len(service.Spec.Selector) == 0 {
+		return nil
+	}
+	pods, err := c.podInformer.Lister().Pods(service.Namespace).List(labels.SelectorFromSet(service.Spec.Selector))
+	if err != nil {
+		log.Errorf("Failed to list pods of service: %s/%s: %v", service.Namespace, service.Name, err)
+		return nil
+	}
+	// Pods are sorted to render entries in a stable order
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	return pods
+}
+
+// restrictsPorts checks if a service is opted in to port restriction, either directly or via its namespace.
+// An annotation on the service takes precedence over its namespace
+func (c *PolicyController) restrictsPorts(service *v1.Service) bool {
+	if value, ok := service.Annotations[restrictPortsAnnotation]; ok {
+		return value == "true"
+	}
+	namespace, err := c.namespaceInformer.Lister().Get(service.Namespace)
+	if err != nil {
+		return false
+	}
+	return namespace.Annotations[restrictPortsAnnotation] == "true"
+}
+
+// allPorts returns every protocol and port declared by a service
+func allPorts(service *v1.Service) []servicePort {
+	var ports []servicePort
+	for _, port := range service.Spec.Ports {
+		protocol, ok := protocolNumbers[port.Protocol]
+		if !ok {
+			continue
+		}
+		ports = append(ports, servicePort{Protocol: protocol, Port: uint16(port.Port)})
+	}
+	return ports
+}
+
+// podPort resolves a port of a pod, given either as a number or as the name of a container port, returning 0 if the name is unknown
+func podPort(pod *v1.Pod, port intstr.IntOrString, protocol v1.Protocol) int32 {
+	if port.Type == intstr.Int {
+		return port.IntVal
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			containerProtocol := containerPort.Protocol
+			if containerProtocol == "" {
+				containerProtocol = v1.ProtocolTCP
+			}
+			if containerPort.Name == port.StrVal && containerProtocol == protocol {
+				return containerPort.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+// policyPortMatches checks if a port of a pod is matched by a NetworkPolicy port, which may be a range or a named port
+func policyPortMatches(policyPort networkingv1.NetworkPolicyPort, pod *v1.Pod, port int32, protocol v1.Protocol) bool {
+	if policyPort.Port == nil {
+		return true
+	}
+	if policyPort.Port.Type == intstr.String {
+		return podPort(pod, *policyPort.Port, protocol) == port
+	}
+	if policyPort.EndPort != nil {
+		return port >= policyPort.Port.IntVal && port <= *policyPort.EndPort
+	}
+	return port == policyPort.Port.IntVal
+}
+
+// rulePorts maps the ports of a NetworkPolicy rule, which refer to ports of the selected pods, to the service ports targeting them.
+// Named ports, in either the rule or the target port of the service, are resolved against each pod. A nil result matches all ports
+func rulePorts(service *v1.Service, pods []*v1.Pod, policyPorts []networkingv1.NetworkPolicyPort) []servicePort {
+	if len(policyPorts) == 0 {
+		return nil
+	}
+	ports := []servicePort{}
+	seen := make(map[servicePort]bool)
+	for _, policyPort := range policyPorts {
+		protocol := v1.ProtocolTCP
+		if policyPort.Protocol != nil {
+			protocol = *policyPort.Protocol
+		}
+		for _, port := range service.Spec.Ports {
+			if port.Protocol != protocol {
+				continue
+			}
+			targetPort := port.TargetPort
+			// An unset target port defaults to the service port
+			if targetPort.Type == intstr.Int && targetPort.IntVal == 0 {
+				targetPort = intstr.FromInt(int(port.Port))
+			}
+			matched := servicePort{Protocol: protocolNumbers[protocol], Port: uint16(port.Port)}
+			for _, pod := range pods {
+				podTargetPort := podPort(pod, targetPort, protocol)
+				if podTargetPort == 0 || !policyPortMatches(policyPort, pod, podTargetPort, protocol) {
+					continue
+				}
+				if !seen[matched] {
+					seen[matched] = true
+					ports = append(ports, matched)
+				}
+				break
+			}
+		}
+	}
+	return ports
+}
+
+// selectingPolicy is a NetworkPolicy selecting some of the pods backing a service
+type selectingPolicy struct {
+	policy *networkingv1.NetworkPolicy
+	pods   []*v1.Pod
+}
+
+// renderServiceACL renders the entries restricting ingress to the external addresses of a service according to the NetworkPolicies selecting its pods.
+// Only ipBlock peers are rendered, as other peers are within the cluster and never reach the external address via the fabric.
+// The except ranges of an ipBlock are left out of its accepted prefixes rather than dropped, as other rules may still allow them.
+// When restrictPorts is set, only the ports declared by the service are accepted. Entries are numbered by numberEntries
+func renderServiceACL(service *v1.Service, pods []*v1.Pod, policies []*networkingv1.NetworkPolicy, restrictPorts bool) []fabric.ACLEntry {
+	var entries []fabric.ACLEntry
+	var selecting []selectingPolicy
+	for _, policy := range policies {
+		if selected := selectsService(policy, service, pods); len(selected) > 0 {
+			selecting = append(selecting, selectingPolicy{policy: policy, pods: selected})
+		}
+	}
+	if len(selecting) == 0 && !restrictPorts {
+		return nil
+	}
+	sort.Slice(selecting, func(i, j int) bool { return selecting[i].policy.Name < selecting[j].policy.Name })
+	declaredPorts := allPorts(service)
+
+	addEntry := func(entry fabric.ACLEntry) {
+		entries = append(entries, entry)
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP == "" {
+			continue
+		}
+		destination := fabric.HostPrefix(ingress.IP)
+		isIPv6 := fabric.ACLEntry{DestinationPrefix: destination}.Family() == "ipv6"
+		for _, selected := range selecting {
+			policy := selected.policy
+			for ruleIndex, rule := range policy.Spec.Ingress {
+				description := fmt.Sprintf("%s/%s ingress rule %d", policy.Namespace, policy.Name, ruleIndex)
+				var sources []string
+				if len(rule.From) == 0 {
+					// No peers allows all sources
+					sources = append(sources, "")
+				}
+				for _, peer := range rule.From {
+					if peer.IPBlock == nil {
+						continue
+					}
+					if (fabric.ACLEntry{SourcePrefix: peer.IPBlock.CIDR}.Family() == "ipv6") != isIPv6 {
+						continue
+					}
+					sources = append(sources, subtractPrefixes(peer.IPBlock.CIDR, peer.IPBlock.Except)...)
+				}
+				ports := rulePorts(service, selected.pods, rule.Ports)
+				if ports != nil && len(ports) == 0 {
+					// None of the ports in the rule are exposed by the service
+					continue
+				}
+				if ports == nil {
+					ports = []servicePort{{}}
+					if restrictPorts {
+						ports = declaredPorts
+					}
+				}
+				for _, source := range sources {
+					for _, port := range ports {
+						addEntry(fabric.ACLEntry{Description: description, SourcePrefix: source, DestinationPrefix: destination, Protocol: port.Protocol, DestinationPort: port.Port, Accept: true})
+					}
+				}
+			}
+		}
+		if len(selecting) == 0 {
+			// Without policies, the declared ports are open to any source
+			for _, port := range declaredPorts {
+				addEntry(fabric.ACLEntry{Description: fmt.Sprintf("%s/%s declared port", service.Namespace, service.Name), DestinationPrefix: destination, Protocol: port.Protocol, DestinationPort: port.Port, Accept: true})
+			}
+		}
+		// Traffic to the external address not allowed by any policy or declared port is dropped
+		addEntry(fabric.ACLEntry{Description: fmt.Sprintf("%s/%s default deny", service.Namespace, service.Name), DestinationPrefix: destination})
+	}
+	return entries
+}
+
+// subtractPrefixes returns the prefixes covering cidr with the except ranges left out, ordered by address.
+// An invalid cidr yields no prefixes, invalid except ranges and ranges outside cidr are ignored
+func subtractPrefixes(cidr string, except []string) []string {
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		log.Errorf("Invalid ipBlock CIDR in NetworkPolicy: %s: %v", cidr, err)
+		return nil
+	}
+	prefixes := []*net.IPNet{block}
+	for _, exceptCIDR := range except {
+		_, excluded, err := net.ParseCIDR(exceptCIDR)
+		if err != nil {
+			log.Errorf("Invalid ipBlock except in NetworkPolicy: %s: %v", exceptCIDR, err)
+			continue
+		}
+		var remaining []*net.IPNet
+		for _, prefix := range prefixes {
+			remaining = append(remaining, subtractPrefix(prefix, excluded)...)
+		}
+		prefixes = remaining
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := bytes.Compare(prefixes[i].IP, prefixes[j].IP); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(prefixes[i].Mask, prefixes[j].Mask) < 0
+	})
+	result := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		result = append(result, prefix.String())
+	}
+	return result
+}
+
+// subtractPrefix returns the prefixes covering prefix with excluded left out.
+// Prefix is halved until the half holding excluded matches it, keeping the other half at each step
+func subtractPrefix(prefix *net.IPNet, excluded *net.IPNet) []*net.IPNet {
+	prefixOnes, bits := prefix.Mask.Size()
+	excludedOnes, excludedBits := excluded.Mask.Size()
+	if bits != excludedBits {
+		return []*net.IPNet{prefix}
+	}
+	if excludedOnes <= prefixOnes {
+		if excluded.Contains(prefix.IP) {
+			return nil
+		}
+		return []*net.IPNet{prefix}
+	}
+	if !prefix.Contains(excluded.IP) {
+		return []*net.IPNet{prefix}
+	}
+	var remaining []*net.IPNet
+	for ones := prefixOnes; ones < excludedOnes; ones++ {
+		mask := net.CIDRMask(ones+1, bits)
+		lower := &net.IPNet{IP: prefix.IP.Mask(mask), Mask: mask}
+		upper := &net.IPNet{IP: append(net.IP(nil), lower.IP...), Mask: mask}
+		upper.IP[ones/8] |= 0x80 >> uint(ones%8)
+		if lower.Contains(excluded.IP) {
+			remaining = append(remaining, upper)
+			prefix = lower
+		} else {
+			remaining = append(remaining, lower)
+			prefix = upper
+		}
+	}
+	return remaining
+}
+
+// allocateSequenceBlock returns the block of sequence ids of a service, allocating the lowest free block if it has none
+func allocateSequenceBlock(serviceKey agent.ServiceKey) (uint32, error) {
+	if block, ok := sequenceBlocks[serviceKey]; ok {
+		return block, nil
+	}
+	used := make(map[uint32]bool, len(sequenceBlocks))
+	for _, block := range sequenceBlocks {
+		used[block] = true
+	}
+	for block := uint32(0); block < maxSequenceBlocks; block++ {
+		if !used[block] {
+			sequenceBlocks[serviceKey] = block
+			return block, nil
+		}
+	}
+	return 0, fmt.Errorf("all %d blocks of sequence ids are allocated", maxSequenceBlocks)
+}
+
+// numberEntries numbers the entries of a service consecutively within its block of sequence ids,
+// rejecting services with more entries than fit in a block
+func numberEntries(entries []fabric.ACLEntry, block uint32) error {
+	if len(entries) > sequenceBlockSize {
+		return fmt.Errorf("%d entries rendered, only %d fit in the sequence ids of a service", len(entries), sequenceBlockSize)
+	}
+	first := sequenceStart + block*sequenceBlockSize
+	for i := range entries {
+		entries[i].SequenceID = first + uint32(i)
+	}
+	return nil
+}
+
+// aclEntryKey returns the key of an entry within appliedEntries
+func aclEntryKey(entry fabric.ACLEntry) string {
+	return fmt.Sprintf("%s/%d", entry.Family(), entry.SequenceID)
+}
+
+// aclEntryState converts an entry to its YANG representation
+func aclEntryState(entry fabric.ACLEntry, applied bool) config.ACLEntry {
+	var state config.ACLEntry
+	state.SequenceID = entry.SequenceID
+	state.Filter.Value = fmt.Sprintf("%s-filter %s", entry.Family(), aclFilterName)
+	state.Description.Value = entry.Description
+	state.SourcePrefix.Value = entry.SourcePrefix
+	state.DestinationPrefix.Value = entry.DestinationPrefix
+	state.Protocol.Value = "any"
+	for protocol, number := range protocolNumbers {
+		if number == entry.Protocol {
+			state.Protocol.Value = string(protocol)
+		}
+	}
+	state.DestinationPort.Value = uint32(entry.DestinationPort)
+	state.Action.Value = "drop"
+	if entry.Accept {
+		state.Action.Value = "accept"
+	}
+	state.Applied.Value = applied
+	return state
+}
+
+// seedAppliedEntries records the entries of the filters already on the switch as applied
+func seedAppliedEntries() error {
+	seeded := make(map[string]fabric.ACLEntry)
+	for _, family := range []string{"ipv4", "ipv6"} {
+		entries, err := fabric.ACLEntries(family, aclFilterName)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve entries of %s filter: %s: %v", family, aclFilterName, err)
+		}
+		for _, entry := range entries {
+			seeded[aclEntryKey(entry)] = entry
+		}
+	}
+	if len(seeded) > 0 {
+		log.Infof("Found %d ACL entries applied to filter: %s", len(seeded), aclFilterName)
+	}
+	appliedEntries = seeded
+	entriesSeeded = true
+	return nil
+}
+
+// currentBindings returns the filters bound to the input of subinterfaces on the switch, for both families
+func currentBindings() (map[fabric.ACLBinding]string, error) {
+	bound := make(map[fabric.ACLBinding]string)
+	for _, family := range []string{"ipv4", "ipv6"} {
+		bindings, err := fabric.ACLBindings(family)
+		if err != nil {
+			return nil, err
+		}
+		for binding, filterName := range bindings {
+			bound[binding] = filterName
+		}
+	}
+	return bound, nil
+}
+
+// applyEntries brings the entries applied to the switch, and the subinterfaces the filters are bound to, in line with the desired ones.
+// Bindings are compared to those on the switch, so subinterfaces bound before a restart are unbound once no longer configured.
+// Subinterfaces with a filter of others bound are neither bound nor unbound.
+// All changes are applied in a single transaction, so that stale entries are never removed before their replacements are in place
+func applyEntries(desired map[string]fabric.ACLEntry, bindings map[fabric.ACLBinding]bool) {
+	bound, err := currentBindings()
+	if err != nil {
+		log.Errorf("Failed to retrieve filters bound to subinterfaces: %v", err)
+		return
+	}
+	change := fabric.ACLChange{FilterName: aclFilterName}
+	for key, entry := range appliedEntries {
+		if _, ok := desired[key]; !ok {
+			log.Infof("Deleting ACL entry: %s", key)
+			change.Delete = append(change.Delete, entry)
+		}
+	}
+	statistics := make(map[string]bool)
+	for key, entry := range desired {
+		if !statisticsEnabled[entry.Family()] && !statistics[entry.Family()] {
+			statistics[entry.Family()] = true
+			change.Statistics = append(change.Statistics, entry.Family())
+		}
+		if applied, ok := appliedEntries[key]; ok && applied == entry {
+			continue
+		}
+		log.Infof("Setting ACL entry: %s, %+v", key, entry)
+		change.Set = append(change.Set, entry)
+	}
+	for binding, filterName := range bound {
+		if filterName == aclFilterName && !bindings[binding] {
+			log.Infof("Unbinding %s filter: %s from subinterface: %s", binding.Family, aclFilterName, binding.Subinterface)
+			change.Unbind = append(change.Unbind, binding)
+		}
+	}
+	foreign := make(map[fabric.ACLBinding]string)
+	for binding := range bindings {
+		filterName, ok := bound[binding]
+		if filterName == aclFilterName {
+			continue
+		}
+		if ok {
+			if foreignBindings[binding] != filterName {
+				log.Errorf("Not binding %s filter: %s to subinterface: %s, filter: %s is already bound to it", binding.Family, aclFilterName, binding.Subinterface, filterName)
+			}
+			foreign[binding] = filterName
+			continue
+		}
+		log.Infof("Binding %s filter: %s to subinterface: %s", binding.Family, aclFilterName, binding.Subinterface)
+		change.Bind = append(change.Bind, binding)
+	}
+	foreignBindings = foreign
+	if change.Empty() {
+		return
+	}
+	if err := fabric.ApplyACLChange(Ctx, change); err != nil {
+		log.Errorf("Failed to apply ACL changes to filter: %s: %v", aclFilterName, err)
+		return
+	}
+	appliedEntries = desired
+	for family := range statistics {
+		statisticsEnabled[family] = true
+	}
+}
+
+// reconcile renders the ACLs for all services, applying them to the switch unless in dry-run and publishing them to NDK.
+// NetworkPolicies are only rendered when enabled in config, services opted in to port restriction always are
+func (c *PolicyController) reconcile() {
+	if !entriesSeeded {
+		// Without the entries already applied, stale entries would never be removed
+		if err := seedAppliedEntries(); err != nil {
+			log.Errorf("Not reconciling ACLs: %v", err)
+			return
+		}
+	}
+	cfg := KButler.Config()
+	mode := cfg.NetworkPolicyACL.Value
+	rendered := make(map[agent.ServiceKey][]fabric.ACLEntry)
+	services, err := c.serviceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		log.Errorf("Failed to list services: %v", err)
+		return
+	}
+	var policies []*networkingv1.NetworkPolicy
+	if mode == "dry-run" || mode == "enabled" {
+		policies, err = c.policyInformer.Lister().List(labels.Everything())
+		if err != nil {
+			log.Errorf("Failed to list network policies: %v", err)
+			return
+		}
+	}
+	// Services are rendered in a stable order, so blocks of sequence ids are allocated in the same order after a restart
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	for _, service := range services {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		serviceKey := agent.ServiceKey{Name: service.Name, Namespace: service.Namespace}
+		entries := renderServiceACL(service, c.backingPods(service), policies, c.restrictsPorts(service))
+		if len(entries) == 0 {
+			continue
+		}
+		block, err := allocateSequenceBlock(serviceKey)
+		if err == nil {
+			err = numberEntries(entries, block)
+		}
+		if err != nil {
+			log.Errorf("Rejecting ACL entries of service: %s/%s: %v", service.Namespace, service.Name, err)
+			continue
+		}
+		rendered[serviceKey] = entries
+	}
+	// Blocks of services without entries are freed for other services
+	for serviceKey := range sequenceBlocks {
+		if _, ok := rendered[serviceKey]; !ok {
+			delete(sequenceBlocks, serviceKey)
+		}
+	}
+
+	applied := mode != "dry-run"
+	desired := make(map[string]fabric.ACLEntry)
+	bindings := make(map[fabric.ACLBinding]bool)
+	if applied {
+		for _, entries := range rendered {
+			for _, entry := range entries {
+				desired[aclEntryKey(entry)] = entry
+				// Traffic not destined to a restricted external address is accepted
+				defaultEntry := fabric.ACLEntry{SequenceID: defaultSequenceID, Description: "kbutler default accept", Accept: true}
+				if entry.Family() == "ipv6" {
+					defaultEntry.DestinationPrefix = "::/0"
+				}
+				desired[aclEntryKey(defaultEntry)] = defaultEntry
+				// The filter of each family with entries is bound to the configured subinterfaces
+				for _, subinterface := range cfg.ACLSubinterfaces {
+					bindings[fabric.ACLBinding{Subinterface: subinterface.Value, Family: entry.Family()}] = true
+				}
+			}
+		}
+	}
+	applyEntries(desired, bindings)
+	matchedPackets := readCounters()
+
+	KButler.Lock()
+	defer KButler.Unlock()
+	for serviceKey, entries := range rendered {
+		var state []config.ACLEntry
+		for _, entry := range entries {
+			appliedEntry, entryApplied := appliedEntries[aclEntryKey(entry)]
+			entryState := aclEntryState(entry, applied && entryApplied && appliedEntry == entry)
+			if entryState.Applied.Value {
+				entryState.MatchedPackets.Value = matchedPackets[aclEntryKey(entry)]
+			}
+			state = append(state, entryState)
+		}
+		old := KButler.YangACL[serviceKey]
+		if reflect.DeepEqual(old, state) {
+			continue
+		}
+		KButler.YangACL[serviceKey] = state
+		KButler.UpdateServiceACLTelemetry(serviceKey, old)
+	}
+	for serviceKey, old := range KButler.YangACL {
+		if _, ok := rendered[serviceKey]; !ok {
+			delete(KButler.YangACL, serviceKey)
+			KButler.UpdateServiceACLTelemetry(serviceKey, old)
+		}
+	}
+	metrics.ReconcileCompleted("policymgr")
+}
+
+// readCounters retrieves the matched packet counters of the applied entries, keyed as in appliedEntries
+func readCounters() map[string]uint64 {
+	counters := make(map[string]uint64)
+	families := make(map[string]bool)
+	for _, entry := range appliedEntries {
+		families[entry.Family()] = true
+	}
+	for family := range families {
+		matched, err := fabric.ACLMatchedPackets(family, aclFilterName)
+		if err != nil {
+			log.Errorf("Failed to retrieve ACL counters for %s filter: %s: %v", family, aclFilterName, err)
+			continue
+		}
+		for sequenceID, packets := range matched {
+			counters[fmt.Sprintf("%s/%d", family, sequenceID)] = packets
+		}
+	}
+	return counters
+}
+
+// triggerReconcile requests a reconcile, coalescing requests made while one is pending
+func (c *PolicyController) triggerReconcile(obj interface{}) {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *PolicyController) Run(ctx context.Context) error {
+	// Starts all the shared informers that have been created by the factory so far
+	c.informerFactory.Start(ctx.Done())
+	// wait for the initial synchronization of the local cache
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.policyInformer.Informer().HasSynced, c.serviceInformer.Informer().HasSynced, c.namespaceInformer.Informer().HasSynced, c.podInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
+	}
+	return nil
+}
+
+// NewPolicyController creates a PolicyController
+func NewPolicyController(informerFactory informers.SharedInformerFactory) *PolicyController {
+	policyInformer := informerFactory.Networking().V1().NetworkPolicies()
+	serviceInformer := informerFactory.Core().V1().Services()
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	podInformer := informerFactory.Core().V1().Pods()
+
+	c := &PolicyController{
+		informerFactory:   informerFactory,
+		policyInformer:    policyInformer,
+		serviceInformer:   serviceInformer,
+		namespaceInformer: namespaceInformer,
+		podInformer:       podInformer,
+		trigger:           make(chan struct{}, 1),
+	}
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.triggerReconcile,
+		UpdateFunc: func(old, new interface{}) { c.triggerReconcile(new) },
+		DeleteFunc: c.triggerReconcile,
+	}
+	health.WatchInformer("policymgr/networkpolicies", policyInformer.Informer())
+	health.WatchInformer("policymgr/services", serviceInformer.Informer())
+	health.WatchInformer("policymgr/namespaces", namespaceInformer.Informer())
+	policyInformer.Informer().AddEventHandler(handlers)
+	serviceInformer.Informer().AddEventHandler(handlers)
+	namespaceInformer.Informer().AddEventHandler(handlers)
+	health.WatchInformer("policymgr/pods", podInformer.Informer())
+	// Pods only change which policies select a service when they come and go or their labels change
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.triggerReconcile,
+		UpdateFunc: func(old, new interface{}) {
+			if !reflect.DeepEqual(old.(*v1.Pod).Labels, new.(*v1.Pod).Labels) {
+				c.triggerReconcile(new)
+			}
+		},
+		DeleteFunc: c.triggerReconcile,
+	})
+	return c
+}
+
+// PolicyMgr renders NetworkPolicies and declared service ports from K8 into ACLs protecting service external addresses
+func PolicyMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+	KButler = kButler
+	ClientSet = clientSet
+	Ctx = ctx
+	defer KButler.Wg.Done()
+
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
+	controller := NewPolicyController(informerFactory)
+
+	if !KButler.SyncCaches(ctx, "policymgr", func() error { return controller.Run(ctx) }) {
+		return
+	}
+	KButler.CacheSync.Done()
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-controller.trigger:
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Infof("Stopping PolicyMgr...")
+			return
+		}
+		controller.reconcile()
+	}
+}
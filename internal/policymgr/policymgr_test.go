@@ -0,0 +1,293 @@
+package policymgr
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testService(targetPort intstr.IntOrString) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeLoadBalancer,
+			Selector: map[string]string{"app": "web"},
+			Ports: []v1.ServicePort{
+				{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, TargetPort: targetPort},
+			},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}}},
+		},
+	}
+}
+
+func testPod() *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", Labels: map[string]string{"app": "web", "tier": "frontend"}},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "web",
+				Ports: []v1.ContainerPort{{Name: "web-http", ContainerPort: 8080, Protocol: v1.ProtocolTCP}},
+			}},
+		},
+	}
+}
+
+func testPolicy(selector map[string]string, policyPorts []networkingv1.NetworkPolicyPort, peers ...networkingv1.IPBlock) *networkingv1.NetworkPolicy {
+	rule := networkingv1.NetworkPolicyIngressRule{Ports: policyPorts}
+	for i := range peers {
+		rule.From = append(rule.From, networkingv1.NetworkPolicyPeer{IPBlock: &peers[i]})
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "allow-web", Namespace: "default"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: selector},
+			Ingress:     []networkingv1.NetworkPolicyIngressRule{rule},
+		},
+	}
+}
+
+func port(value intstr.IntOrString) []networkingv1.NetworkPolicyPort {
+	return []networkingv1.NetworkPolicyPort{{Port: &value}}
+}
+
+func TestRenderServiceACL(t *testing.T) {
+	const (
+		destination = "192.0.2.10/32"
+		rule        = "default/allow-web ingress rule 0"
+		deny        = "default/web default deny"
+	)
+	endPort := int32(8090)
+	egress := testPolicy(map[string]string{"tier": "frontend"}, nil, networkingv1.IPBlock{CIDR: "10.0.0.0/8"})
+	egress.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}
+	// The except of one policy or rule is allowed by another, which NetworkPolicy rules being additive must not drop
+	exceptPolicy := testPolicy(map[string]string{"app": "web"}, nil, networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.64.0.0/10"}})
+	allowExcepted := testPolicy(map[string]string{"app": "web"}, nil, networkingv1.IPBlock{CIDR: "10.1.0.0/16"})
+	allowExcepted.Name = "allow-excepted"
+	twoRules := testPolicy(map[string]string{"app": "web"}, nil, networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.64.0.0/10"}})
+	twoRules.Spec.Ingress = append(twoRules.Spec.Ingress, testPolicy(map[string]string{"app": "web"}, port(intstr.FromInt(8080)), networkingv1.IPBlock{CIDR: "10.64.0.0/10"}).Spec.Ingress...)
+
+	tests := []struct {
+		name          string
+		service       *v1.Service
+		policies      []*networkingv1.NetworkPolicy
+		restrictPorts bool
+		want          []fabric.ACLEntry
+	}{
+		{
+			name:    "no policies",
+			service: testService(intstr.FromInt(8080)),
+		},
+		{
+			name:          "declared ports only",
+			service:       testService(intstr.FromInt(8080)),
+			restrictPorts: true,
+			want: []fabric.ACLEntry{
+				{Description: "default/web declared port", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "policy selecting pod labels not in the service selector",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"tier": "frontend"}, port(intstr.FromInt(8080)), networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}})},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/16", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.2.0.0/15", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.4.0.0/14", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.8.0.0/13", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.16.0.0/12", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.32.0.0/11", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.64.0.0/10", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: rule, SourcePrefix: "10.128.0.0/9", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "except allowed by another policy",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{exceptPolicy, allowExcepted},
+			want: []fabric.ACLEntry{
+				{Description: "default/allow-excepted ingress rule 0", SourcePrefix: "10.1.0.0/16", DestinationPrefix: destination, Accept: true},
+				{Description: rule, SourcePrefix: "10.0.0.0/10", DestinationPrefix: destination, Accept: true},
+				{Description: rule, SourcePrefix: "10.128.0.0/9", DestinationPrefix: destination, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "except allowed by another rule",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{twoRules},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/10", DestinationPrefix: destination, Accept: true},
+				{Description: rule, SourcePrefix: "10.128.0.0/9", DestinationPrefix: destination, Accept: true},
+				{Description: "default/allow-web ingress rule 1", SourcePrefix: "10.64.0.0/10", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "policy selecting other pods",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"tier": "backend"}, nil, networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+		},
+		{
+			name:     "egress policy",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{egress},
+		},
+		{
+			name:     "named policy port and target port",
+			service:  testService(intstr.FromString("web-http")),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"app": "web"}, port(intstr.FromString("web-http")), networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/8", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "numbered policy port matching named target port",
+			service:  testService(intstr.FromString("web-http")),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"app": "web"}, port(intstr.FromInt(8080)), networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/8", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:    "policy port range",
+			service: testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"app": "web"}, []networkingv1.NetworkPolicyPort{{Port: &intstr.IntOrString{IntVal: 8000}, EndPort: &endPort}},
+				networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/8", DestinationPrefix: destination, Protocol: 6, DestinationPort: 80, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "policy port not exposed by the service",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"app": "web"}, port(intstr.FromInt(9090)), networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+			want: []fabric.ACLEntry{
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+		{
+			name:     "peers of another family",
+			service:  testService(intstr.FromInt(8080)),
+			policies: []*networkingv1.NetworkPolicy{testPolicy(map[string]string{"app": "web"}, nil, networkingv1.IPBlock{CIDR: "2001:db8::/32"}, networkingv1.IPBlock{CIDR: "10.0.0.0/8"})},
+			want: []fabric.ACLEntry{
+				{Description: rule, SourcePrefix: "10.0.0.0/8", DestinationPrefix: destination, Accept: true},
+				{Description: deny, DestinationPrefix: destination},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderServiceACL(tt.service, []*v1.Pod{testPod()}, tt.policies, tt.restrictPorts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("renderServiceACL() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	tests := []struct {
+		name   string
+		cidr   string
+		except []string
+		want   []string
+	}{
+		{name: "no except", cidr: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{name: "lower half", cidr: "10.0.0.0/8", except: []string{"10.0.0.0/9"}, want: []string{"10.128.0.0/9"}},
+		{name: "nested", cidr: "10.0.0.0/8", except: []string{"10.64.0.0/10"}, want: []string{"10.0.0.0/10", "10.128.0.0/9"}},
+		{name: "host", cidr: "192.0.2.0/30", except: []string{"192.0.2.1/32"}, want: []string{"192.0.2.0/32", "192.0.2.2/31"}},
+		{name: "several", cidr: "10.0.0.0/8", except: []string{"10.0.0.0/9", "10.192.0.0/10"}, want: []string{"10.128.0.0/10"}},
+		{name: "whole block", cidr: "10.0.0.0/8", except: []string{"10.0.0.0/8"}, want: []string{}},
+		{name: "outside the block", cidr: "10.0.0.0/8", except: []string{"192.168.0.0/16"}, want: []string{"10.0.0.0/8"}},
+		{name: "ipv6", cidr: "2001:db8::/32", except: []string{"2001:db8:8000::/33"}, want: []string{"2001:db8::/33"}},
+		{name: "invalid cidr", cidr: "10.0.0.0", want: nil},
+		{name: "invalid except", cidr: "10.0.0.0/8", except: []string{"10.1.0.0"}, want: []string{"10.0.0.0/8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := subtractPrefixes(tt.cidr, tt.except)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("subtractPrefixes(%q, %q) = %q, want %q", tt.cidr, tt.except, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries int
+		block   uint32
+		first   uint32
+		wantErr bool
+	}{
+		{name: "first block", entries: 3, block: 0, first: sequenceStart},
+		{name: "later block", entries: 3, block: 2, first: sequenceStart + 2*sequenceBlockSize},
+		{name: "full block", entries: sequenceBlockSize, block: maxSequenceBlocks - 1, first: sequenceStart + (maxSequenceBlocks-1)*sequenceBlockSize},
+		{name: "overflowing block", entries: sequenceBlockSize + 1, block: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]fabric.ACLEntry, tt.entries)
+			err := numberEntries(entries, tt.block)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("numberEntries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			for i, entry := range entries {
+				if entry.SequenceID != tt.first+uint32(i) {
+					t.Errorf("entry %d has sequence id %d, want %d", i, entry.SequenceID, tt.first+uint32(i))
+				}
+				if entry.SequenceID >= defaultSequenceID {
+					t.Errorf("entry %d has sequence id %d, overlapping the default entry", i, entry.SequenceID)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateSequenceBlock(t *testing.T) {
+	defer func() { sequenceBlocks = make(map[agent.ServiceKey]uint32) }()
+	sequenceBlocks = make(map[agent.ServiceKey]uint32)
+	a := agent.ServiceKey{Namespace: "default", Name: "a"}
+	b := agent.ServiceKey{Namespace: "default", Name: "b"}
+	c := agent.ServiceKey{Namespace: "default", Name: "c"}
+	for _, step := range []struct {
+		key     agent.ServiceKey
+		release *agent.ServiceKey
+		want    uint32
+	}{
+		{key: a, want: 0},
+		{key: b, want: 1},
+		{key: a, want: 0},
+		{key: c, release: &a, want: 0},
+		{key: b, want: 1},
+	} {
+		if step.release != nil {
+			delete(sequenceBlocks, *step.release)
+		}
+		got, err := allocateSequenceBlock(step.key)
+		if err != nil {
+			t.Fatalf("allocateSequenceBlock(%v) error = %v", step.key, err)
+		}
+		if got != step.want {
+			t.Errorf("allocateSequenceBlock(%v) = %d, want %d", step.key, got, step.want)
+		}
+	}
+}
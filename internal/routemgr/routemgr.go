@@ -0,0 +1,291 @@
+package routemgr
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brwallis/srlinux-kbutler/internal/agent"
+	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/fabric"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
+
+	log "k8s.io/klog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// networkInstance is the network instance routes are programmed in
+	networkInstance = "default"
+	// reconcileInterval is how often the programmed routes are checked, picking up configuration changes and retrying failures
+	reconcileInterval = 30 * time.Second
+)
+
+var (
+	KButler   *agent.Agent
+	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+
+	// programmedRoutes holds the routes currently programmed via NDK, keyed by prefix
+	programmedRoutes = make(map[string]ownedRoute)
+)
+
+// ownedRoute is a route to an external address, via the nodes backing the services sharing the address.
+// The route is kept as long as any of its services remains
+type ownedRoute struct {
+	ServiceKeys  []agent.ServiceKey
+	NextHopGroup string
+	NextHops     []string
+}
+
+// samePath checks if two routes are programmed identically, regardless of the services owning them
+func (r ownedRoute) samePath(other ownedRoute) bool {
+	return r.NextHopGroup == other.NextHopGroup && reflect.DeepEqual(r.NextHops, other.NextHops)
+}
+
+// RouteController struct
+type RouteController struct {
+	informerFactory  informers.SharedInformerFactory
+	serviceInformer  coreinformers.ServiceInformer
+	endpointInformer coreinformers.EndpointsInformer
+	nodeInformer     coreinformers.NodeInformer
+	trigger          chan struct{}
+}
+
+// nextHopGroupName returns the name of the next hop group used for an external address
+func nextHopGroupName(externalAddress string) string {
+	return fmt.Sprintf("kbutler-%s", strings.NewReplacer(".", "-", ":", "-").Replace(externalAddress))
+}
+
+// nodeAddress returns the InternalIP address of a node in the same family as an external address
+func nodeAddress(node *v1.Node, ipv6 bool) string {
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP && strings.Contains(address.Address, ":") == ipv6 {
+			return address.Address
+		}
+	}
+	return ""
+}
+
+// backendNodes returns the names of the nodes with a ready endpoint for a service
+func backendNodes(endpoint *v1.Endpoints) []string {
+	var nodes []string
+	for _, subset := range endpoint.Subsets {
+		for _, address := range subset.Addresses {
+			if address.NodeName != nil && !fabric.ContainsAddress(nodes, *address.NodeName) {
+				nodes = append(nodes, *address.NodeName)
+			}
+		}
+	}
+	return nodes
+}
+
+// desiredRoutes computes the routes to the external addresses of all LoadBalancer services.
+// Services sharing an external address share its route, via the nodes backing any of them
+func (c *RouteController) desiredRoutes() (map[string]ownedRoute, error) {
+	routes := make(map[string]ownedRoute)
+	services, err := c.serviceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		endpoint, err := c.endpointInformer.Lister().Endpoints(service.Namespace).Get(service.Name)
+		if err != nil {
+			continue
+		}
+		nodes := backendNodes(endpoint)
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP == "" {
+				continue
+			}
+			prefix := fabric.HostPrefix(ingress.IP)
+			route, ok := routes[prefix]
+			if !ok {
+				route.NextHopGroup = nextHopGroupName(ingress.IP)
+			}
+			route.ServiceKeys = append(route.ServiceKeys, agent.ServiceKey{Name: service.Name, Namespace: service.Namespace})
+			for _, nodeName := range nodes {
+				node, err := c.nodeInformer.Lister().Get(nodeName)
+				if err != nil {
+					continue
+				}
+				if address := nodeAddress(node, strings.Contains(ingress.IP, ":")); address != "" && !fabric.ContainsAddress(route.NextHops, address) {
+					route.NextHops = append(route.NextHops, address)
+				}
+			}
+			routes[prefix] = route
+		}
+	}
+	for _, route := range routes {
+		sort.Strings(route.NextHops)
+	}
+	return routes, nil
+}
+
+// reconcile brings the routes programmed via NDK in line with the endpoints of each service, publishing them to NDK
+func (c *RouteController) reconcile() {
+	desired := make(map[string]ownedRoute)
+	if KButler.Config().ProgramRoutes.Value {
+		var err error
+		desired, err = c.desiredRoutes()
+		if err != nil {
+			log.Errorf("Failed to compute routes: %v", err)
+			return
+		}
+	}
+	reasons := make(map[string]string)
+
+	// Routes are only removed once none of the services sharing them have backend nodes
+	for prefix, route := range programmedRoutes {
+		if desiredRoute, ok := desired[prefix]; ok && len(desiredRoute.NextHops) > 0 {
+			continue
+		}
+		log.Infof("Removing route: %s, next hop group: %s", prefix, route.NextHopGroup)
+		if err := KButler.RemoveRoute(networkInstance, prefix, route.NextHopGroup); err != nil {
+			log.Errorf("Failed to remove route: %s: %v", prefix, err)
+			continue
+		}
+		delete(programmedRoutes, prefix)
+	}
+	for prefix, route := range desired {
+		if len(route.NextHops) == 0 {
+			// A route without next hops would blackhole traffic, leave the external address to other route sources
+			reasons[prefix] = "no-backend-nodes"
+			continue
+		}
+		if programmed, ok := programmedRoutes[prefix]; ok && programmed.samePath(route) {
+			programmedRoutes[prefix] = route
+			continue
+		}
+		log.Infof("Programming route: %s, next hop group: %s, next hops: %v", prefix, route.NextHopGroup, route.NextHops)
+		if err := KButler.ProgramRoute(networkInstance, prefix, route.NextHopGroup, route.NextHops); err != nil {
+			log.Errorf("Failed to program route: %s: %v", prefix, err)
+			reasons[prefix] = "ndk-error"
+			delete(programmedRoutes, prefix)
+			continue
+		}
+		programmedRoutes[prefix] = route
+	}
+
+	state := make(map[agent.ServiceKey][]config.OwnedRoute)
+	for prefix, route := range desired {
+		var routeState config.OwnedRoute
+		routeState.Prefix = prefix
+		routeState.NextHopGroup.Value = route.NextHopGroup
+		routeState.NextHops.Value = strings.Join(route.NextHops, ",")
+		_, routeState.Programmed.Value = programmedRoutes[prefix]
+		routeState.OperReason.Value = reasons[prefix]
+		for _, serviceKey := range route.ServiceKeys {
+			state[serviceKey] = append(state[serviceKey], routeState)
+		}
+	}
+	KButler.Lock()
+	defer KButler.Unlock()
+	for serviceKey, routes := range state {
+		sort.Slice(routes, func(i, j int) bool { return routes[i].Prefix < routes[j].Prefix })
+		old := KButler.YangRoute[serviceKey]
+		if reflect.DeepEqual(old, routes) {
+			continue
+		}
+		KButler.YangRoute[serviceKey] = routes
+		KButler.UpdateServiceRouteTelemetry(serviceKey, old)
+	}
+	for serviceKey, old := range KButler.YangRoute {
+		if _, ok := state[serviceKey]; !ok {
+			delete(KButler.YangRoute, serviceKey)
+			KButler.UpdateServiceRouteTelemetry(serviceKey, old)
+		}
+	}
+	metrics.ReconcileCompleted("routemgr")
+}
+
+// triggerReconcile requests a reconcile, coalescing requests made while one is pending
+func (c *RouteController) triggerReconcile(obj interface{}) {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *RouteController) Run(ctx context.Context) error {
+	// Starts all the shared informers that have been created by the factory so far
+	c.informerFactory.Start(ctx.Done())
+	// wait for the initial synchronization of the local cache
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.serviceInformer.Informer().HasSynced, c.endpointInformer.Informer().HasSynced, c.nodeInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
+	}
+	return nil
+}
+
+// NewRouteController creates a RouteController
+func NewRouteController(informerFactory informers.SharedInformerFactory) *RouteController {
+	serviceInformer := informerFactory.Core().V1().Services()
+	endpointInformer := informerFactory.Core().V1().Endpoints()
+	nodeInformer := informerFactory.Core().V1().Nodes()
+
+	c := &RouteController{
+		informerFactory:  informerFactory,
+		serviceInformer:  serviceInformer,
+		endpointInformer: endpointInformer,
+		nodeInformer:     nodeInformer,
+		trigger:          make(chan struct{}, 1),
+	}
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.triggerReconcile,
+		UpdateFunc: func(old, new interface{}) { c.triggerReconcile(new) },
+		DeleteFunc: c.triggerReconcile,
+	}
+	health.WatchInformer("routemgr/services", serviceInformer.Informer())
+	health.WatchInformer("routemgr/endpoints", endpointInformer.Informer())
+	health.WatchInformer("routemgr/nodes", nodeInformer.Informer())
+	serviceInformer.Informer().AddEventHandler(handlers)
+	endpointInformer.Informer().AddEventHandler(handlers)
+	nodeInformer.Informer().AddEventHandler(handlers)
+	return c
+}
+
+// RouteMgr programs routes to service external addresses via the nodes backing them, when enabled in config
+func RouteMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+	KButler = kButler
+	ClientSet = clientSet
+	Ctx = ctx
+	defer KButler.Wg.Done()
+
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
+	controller := NewRouteController(informerFactory)
+
+	if !KButler.SyncCaches(ctx, "routemgr", func() error { return controller.Run(ctx) }) {
+		return
+	}
+	KButler.CacheSync.Done()
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-controller.trigger:
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Infof("Stopping RouteMgr...")
+			return
+		}
+		controller.reconcile()
+	}
+}
@@ -3,10 +3,15 @@ package servicemgr
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/brwallis/srlinux-kbutler/internal/agent"
 	"github.com/brwallis/srlinux-kbutler/internal/config"
+	"github.com/brwallis/srlinux-kbutler/internal/health"
+	"github.com/brwallis/srlinux-kbutler/internal/k8s"
+	"github.com/brwallis/srlinux-kbutler/internal/metrics"
 
 	log "k8s.io/klog"
 
@@ -18,13 +23,15 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-const (
-	yangRoot = ".kbutler"
-)
-
 var (
 	KButler   *agent.Agent
 	ClientSet *kubernetes.Clientset
+	// Ctx is cancelled when kbutler shuts down
+	Ctx context.Context
+
+	// pendingTimers holds the timers escalating pending services to down
+	pendingTimers   = make(map[agent.ServiceKey]*pendingTimer)
+	pendingTimersMu sync.Mutex
 )
 
 // ServiceController struct
@@ -36,7 +43,7 @@ type ServiceController struct {
 // getExternalIPForService takes a service name and namespace, and returns the external IP address
 func getExternalIPForService(serviceName string, namespace string) string {
 	var externalAddress string
-	service, err := ClientSet.CoreV1().Services(namespace).Get(context.Background(), serviceName, metav1.GetOptions{})
+	service, err := ClientSet.CoreV1().Services(namespace).Get(Ctx, serviceName, metav1.GetOptions{})
 	if err != nil {
 		log.Errorf("Error retrieving service with name: %s, %e", serviceName, err)
 	}
@@ -52,21 +59,194 @@ func getExternalIPForService(serviceName string, namespace string) string {
 	return externalAddress
 }
 
+// filterMetadata returns the subset of labels or annotations that are published against a service,
+// as configured by published-metadata
+func filterMetadata(metadata map[string]string) map[string]string {
+	filtered := make(map[string]string)
+	publishedMetadata := KButler.Config().PublishedMetadata
+	for key, value := range metadata {
+		for _, entry := range publishedMetadata {
+			published := entry.Value
+			if key == published || (strings.HasSuffix(published, "/") && strings.HasPrefix(key, published)) {
+				filtered[key] = value
+			}
+		}
+	}
+	return filtered
+}
+
+// buildServiceSpec populates the YANG representation of a service from its spec and status
+func buildServiceSpec(service *v1.Service, serviceData *config.Service) {
+	serviceData.Type.Value = string(service.Spec.Type)
+	if service.Spec.LoadBalancerClass != nil {
+		serviceData.LoadBalancerClass.Value = *service.Spec.LoadBalancerClass
+	}
+	serviceData.ExternalTrafficPolicy.Value = string(service.Spec.ExternalTrafficPolicy)
+	serviceData.HealthCheckNodePort.Value = uint32(service.Spec.HealthCheckNodePort)
+
+	for _, port := range service.Spec.Ports {
+		var portData config.ServicePort
+		portData.Port = port.Port
+		portData.Protocol = string(port.Protocol)
+		portData.Name.Value = port.Name
+		portData.TargetPort.Value = port.TargetPort.String()
+		portData.NodePort.Value = uint32(port.NodePort)
+		serviceData.Port = append(serviceData.Port, portData)
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			serviceData.Ingress = append(serviceData.Ingress, ingress.IP)
+		} else if ingress.Hostname != "" {
+			serviceData.Ingress = append(serviceData.Ingress, ingress.Hostname)
+		}
+	}
+	serviceData.Label = filterMetadata(service.Labels)
+	serviceData.Annotation = filterMetadata(service.Annotations)
+}
+
+// pendingTimer escalates a pending service to down once it has waited for an external address for the configured timeout
+type pendingTimer struct {
+	service *v1.Service
+	started time.Time
+	// timer is nil while the timeout is disabled
+	timer *time.Timer
+}
+
+// stopPendingTimer cancels any pending timeout running for a service
+func stopPendingTimer(serviceKey agent.ServiceKey) {
+	pendingTimersMu.Lock()
+	defer pendingTimersMu.Unlock()
+	if pending, ok := pendingTimers[serviceKey]; ok {
+		if pending.timer != nil {
+			pending.timer.Stop()
+		}
+		delete(pendingTimers, serviceKey)
+	}
+}
+
+// startPendingTimer starts the pending timeout for a service, escalating its oper-state to down if no external address is assigned in time
+func startPendingTimer(service *v1.Service) {
+	serviceKey := agent.ServiceKey{Name: service.Name, Namespace: service.Namespace}
+	pendingTimersMu.Lock()
+	defer pendingTimersMu.Unlock()
+	if pending, ok := pendingTimers[serviceKey]; ok {
+		pending.service = service
+		return
+	}
+	pending := &pendingTimer{service: service, started: time.Now()}
+	pendingTimers[serviceKey] = pending
+	schedulePendingTimer(serviceKey, pending, KButler.Config().PendingTimeout.Value)
+}
+
+// restartPendingTimers reschedules the timers of all pending services once the pending timeout is reconfigured,
+// counting the time each service has already been pending
+func restartPendingTimers(timeout uint32) {
+	pendingTimersMu.Lock()
+	defer pendingTimersMu.Unlock()
+	for serviceKey, pending := range pendingTimers {
+		if pending.timer != nil {
+			pending.timer.Stop()
+		}
+		schedulePendingTimer(serviceKey, pending, timeout)
+	}
+}
+
+// schedulePendingTimer schedules the escalation of a pending service, pendingTimersMu must be held
+func schedulePendingTimer(serviceKey agent.ServiceKey, pending *pendingTimer, timeout uint32) {
+	pending.timer = nil
+	if timeout == 0 {
+		return
+	}
+	remaining := time.Until(pending.started.Add(time.Duration(timeout) * time.Second))
+	pending.timer = time.AfterFunc(remaining, func() {
+		KButler.Lock()
+		defer KButler.Unlock()
+		pendingTimersMu.Lock()
+		// The timer may have been stopped or rescheduled while waiting for the lock
+		current, ok := pendingTimers[serviceKey]
+		if ok && current == pending {
+			delete(pendingTimers, serviceKey)
+		}
+		pendingTimersMu.Unlock()
+		if current != pending {
+			return
+		}
+		// Nothing is published once kbutler is shutting down
+		if Ctx.Err() != nil {
+			return
+		}
+		serviceData, ok := KButler.YangService[serviceKey]
+		if !ok || serviceData.OperState.Value != "pending" {
+			return
+		}
+		log.Infof("Service: %s/%s has been pending for %ds, publishing oper-state down!", serviceKey.Namespace, serviceKey.Name, timeout)
+		serviceData.OperState.Value = "down"
+		KButler.UpdateServiceTelemetry(serviceKey)
+		metrics.ServiceState(serviceKey.Namespace+"/"+serviceKey.Name, serviceData.OperState.Value)
+		k8s.ServiceStateEvent(KButler.Recorder, pending.service, "pending", serviceData.OperState.Value, serviceData.OperReason.Value)
+	})
+}
+
+// processPendingService processes LoadBalancer services still waiting for an external address to be assigned
+func processPendingService(service *v1.Service) {
+	var serviceData config.Service
+	serviceKey := agent.ServiceKey{Name: service.Name, Namespace: service.Namespace}
+	log.Infof("Processing pending service... Service name: %s, requested address: %s", service.Name, service.Spec.LoadBalancerIP)
+
+	var oldServiceState string
+	oldServiceData, ok := KButler.YangService[serviceKey]
+	if ok {
+		oldServiceState = oldServiceData.OperState.Value
+	}
+	if ok && oldServiceData.OperState.Value == "down" && oldServiceData.OperReason.Value == "no-external-address-assigned" {
+		// Already escalated, don't fall back to pending
+		serviceData.OperState = oldServiceData.OperState
+	} else {
+		serviceData.OperState.Value = "pending"
+	}
+	serviceData.OperReason.Value = "no-external-address-assigned"
+	serviceData.RequestedAddress.Value = service.Spec.LoadBalancerIP
+	buildServiceSpec(service, &serviceData)
+	KButler.YangService[serviceKey] = &serviceData
+	KButler.UpdateServiceTelemetry(serviceKey)
+	KButler.UpdateServiceSpecTelemetry(serviceKey, oldServiceData)
+	metrics.ServiceState(serviceKey.Namespace+"/"+serviceKey.Name, serviceData.OperState.Value)
+	k8s.ServiceStateEvent(KButler.Recorder, service, oldServiceState, serviceData.OperState.Value, serviceData.OperReason.Value)
+	startPendingTimer(service)
+}
+
 // processService processes updates to Services
 func processService(service *v1.Service) {
 	var serviceKey agent.ServiceKey
 	var serviceData config.Service
+	KButler.Lock()
+	defer KButler.Unlock()
+	if Ctx.Err() != nil {
+		return
+	}
 	// var externalAddressYang config.ExternalAddress
 	if service.Status.LoadBalancer.Ingress != nil {
 		log.Infof("Processing service... Service name: %s", service.Name)
 
-		// jsPath := fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}", yangRoot, service.Name, service.Namespace)
+		// jsPath := fmt.Sprintf("%s.service{.service_name==\"%s\"&&.namespace==\"%s\"}", KButler.YangRoot, service.Name, service.Namespace)
 		serviceKey.Name = service.Name
 		serviceKey.Namespace = service.Namespace
-		serviceData.OperState.Value = "updating"
-		serviceData.OperReason.Value = "processing-service-update"
+		stopPendingTimer(serviceKey)
+		// Keep the oper-state calculated from endpoints if this service already had an external address
+		oldServiceData, ok := KButler.YangService[serviceKey]
+		if ok && len(oldServiceData.Ingress) > 0 {
+			serviceData.OperState = oldServiceData.OperState
+			serviceData.OperReason = oldServiceData.OperReason
+		} else {
+			serviceData.OperState.Value = "updating"
+			serviceData.OperReason.Value = "processing-service-update"
+		}
+		serviceData.RequestedAddress.Value = service.Spec.LoadBalancerIP
+		buildServiceSpec(service, &serviceData)
 		KButler.YangService[serviceKey] = &serviceData
 		KButler.UpdateServiceTelemetry(serviceKey)
+		KButler.UpdateServiceSpecTelemetry(serviceKey, oldServiceData)
+		metrics.ServiceState(serviceKey.Namespace+"/"+serviceKey.Name, serviceData.OperState.Value)
 		// serviceData, err := json.Marshal(serviceYang)
 		// if err != nil {
 		// 	log.Infof("Failed to marshal data for service: %v", err)
@@ -74,18 +254,34 @@ func processService(service *v1.Service) {
 		// serviceString := string(serviceData)
 		// KButler.UpdateServiceTelemetry(&jsPath, &serviceString)
 
+	} else if service.Spec.Type == v1.ServiceTypeLoadBalancer {
+		processPendingService(service)
 	} else {
 		log.Infof("Skipping processing service: %s, no external IP: %v", service.Name, service.Status.LoadBalancer.Ingress)
+		// A service that stopped being a LoadBalancer is no longer published
+		forgetService(agent.ServiceKey{Name: service.Name, Namespace: service.Namespace})
 	}
 }
 
-// Run starts shared informers and waits for the shared informer cache to synchronize
-func (c *ServiceController) Run(stopCh chan struct{}) error {
+// forgetService stops publishing a service along with its external addresses, KButler.Lock must be held
+func forgetService(serviceKey agent.ServiceKey) {
+	stopPendingTimer(serviceKey)
+	if _, ok := KButler.YangService[serviceKey]; ok {
+		metrics.ServiceState(serviceKey.Namespace+"/"+serviceKey.Name, "")
+	}
+	KButler.DeleteService(serviceKey)
+}
+
+// Run starts shared informers, which stop once the context is cancelled, and waits for the shared informer cache to synchronize.
+// Informers already started are left running, so Run is called again if the cache did not synchronize in time
+func (c *ServiceController) Run(ctx context.Context) error {
 	// Starts all the shared informers that have been created by the factory so far
-	c.informerFactory.Start(stopCh)
+	c.informerFactory.Start(ctx.Done())
 	// wait for the initial synchronization of the local cache
-	if !cache.WaitForCacheSync(stopCh, c.serviceInformer.Informer().HasSynced) {
-		return fmt.Errorf("Failed to sync")
+	syncCtx, cancel := context.WithTimeout(ctx, agent.CacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.serviceInformer.Informer().HasSynced) {
+		return fmt.Errorf("caches not synced within %s", agent.CacheSyncTimeout)
 	}
 	return nil
 }
@@ -93,6 +289,7 @@ func (c *ServiceController) Run(stopCh chan struct{}) error {
 func (c *ServiceController) serviceAdd(obj interface{}) {
 	service := obj.(*v1.Service)
 	log.Infof("Service CREATED: %s/%s", service.Namespace, service.Name)
+	metrics.InformerEvent("servicemgr", "add")
 	log.Infof("Service %s/%s has ClusterIP: %v, ClusterIP/s: %v, ExternalIP/s: %v", service.Namespace, service.Name, service.Spec.ClusterIP, service.Spec.ClusterIPs, service.Spec.ExternalIPs)
 
 	processService(service)
@@ -112,6 +309,12 @@ func (c *ServiceController) serviceUpdate(old, new interface{}) {
 		"Service UPDATED. %s/%s %s",
 		oldService.Namespace, oldService.Name, newService.Name,
 	)
+	metrics.InformerEvent("servicemgr", "update")
+	processService(newService)
+	// Resyncs redeliver every service unchanged, each one recording that the informer went through all services again
+	if oldService.ResourceVersion == newService.ResourceVersion {
+		metrics.ReconcileCompleted("servicemgr")
+	}
 	if newService.Namespace == "kube-system" {
 		if newService.Name == "srlinux-config" {
 			log.Infof("Service has the correct name: %s", newService.Name)
@@ -123,6 +326,10 @@ func (c *ServiceController) serviceUpdate(old, new interface{}) {
 func (c *ServiceController) serviceDelete(obj interface{}) {
 	service := obj.(*v1.Service)
 	log.Infof("Service DELETED: %s/%s", service.Namespace, service.Name)
+	metrics.InformerEvent("servicemgr", "delete")
+	KButler.Lock()
+	defer KButler.Unlock()
+	forgetService(agent.ServiceKey{Name: service.Name, Namespace: service.Namespace})
 }
 
 // NewServiceController creates a ServiceController
@@ -134,6 +341,7 @@ func NewServiceController(informerFactory informers.SharedInformerFactory) *Serv
 		informerFactory: informerFactory,
 		serviceInformer: serviceInformer,
 	}
+	health.WatchInformer("servicemgr/services", serviceInformer.Informer())
 	serviceInformer.Informer().AddEventHandler(
 		// Your custom resource event handlers.
 		cache.ResourceEventHandlerFuncs{
@@ -149,18 +357,28 @@ func NewServiceController(informerFactory informers.SharedInformerFactory) *Serv
 }
 
 // ServiceMgr manages updates of Services from K8
-func ServiceMgr(clientSet *kubernetes.Clientset, kButler *agent.Agent) {
+func ServiceMgr(ctx context.Context, clientSet *kubernetes.Clientset, kButler *agent.Agent) {
 	KButler = kButler
 	ClientSet = clientSet
+	Ctx = ctx
+	defer KButler.Wg.Done()
 
-	informerFactory := informers.NewSharedInformerFactory(clientSet, time.Hour*24)
+	informerFactory := informers.NewSharedInformerFactory(clientSet, KButler.ResyncPeriod)
 	controller := NewServiceController(informerFactory)
+	pendingTimeout := KButler.Config().PendingTimeout.Value
+	KButler.RegisterConfigHandler(func(cfg config.AgentConfig) {
+		if cfg.PendingTimeout.Value != pendingTimeout {
+			pendingTimeout = cfg.PendingTimeout.Value
+			restartPendingTimers(pendingTimeout)
+		}
+	})
 
-	stop := make(chan struct{})
-	defer close(stop)
-	err := controller.Run(stop)
-	if err != nil {
-		log.Fatal(err)
+	if !KButler.SyncCaches(ctx, "servicemgr", func() error { return controller.Run(ctx) }) {
+		return
 	}
-	select {}
+	KButler.CacheSync.Done()
+	// The initial list of the informer processed every service
+	metrics.ReconcileCompleted("servicemgr")
+	<-ctx.Done()
+	log.Infof("Stopping ServiceMgr...")
 }